@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	. "codeberg.org/UnifiedPush/common-proxies/config"
+)
+
+// Admin API, served on its own listener:
+//
+//	GET    /cache              list cached breakers, ?host=https://example.org filters on a host
+//	GET    /cache/lookup?url=  status of an endpoint and of its host
+//	DELETE /cache?url=         purge an endpoint
+//	DELETE /cache?host=        purge a host and all its endpoints
+//	DELETE /cache?all=true     purge everything
+//
+// Every request needs an "Authorization: Bearer <admin.token>" header.
+func adminRouter() *http.ServeMux {
+	router := http.NewServeMux()
+	router.HandleFunc("/cache", bothHandler(adminAuth(adminCacheHandler)))
+	router.HandleFunc("/cache/lookup", bothHandler(adminAuth(adminLookupHandler)))
+	return router
+}
+
+func adminAuth(f HttpHandler) HttpHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(Config.Admin.Token)) != 1 {
+			log.Println("admin: unauthorized request from", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func adminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, struct {
+			Stats   cacheStats       `json:"stats"`
+			Entries []cacheEntryInfo `json:"entries"`
+		}{endpointCache.getStats(), endpointCache.entries(query.Get("host"))})
+	case http.MethodDelete:
+		var n int
+		switch {
+		case query.Has("url"):
+			u, err := url.Parse(query.Get("url"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			key := u.String()
+			n = endpointCache.purge(func(e *cacheEntry) bool { return e.key == key })
+		case query.Has("host"):
+			host := query.Get("host")
+			n = endpointCache.purge(func(e *cacheEntry) bool { return e.host == host || e.key == "host:"+host })
+		case query.Get("all") == "true":
+			n = endpointCache.purge(func(e *cacheEntry) bool { return true })
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Println("admin: purged", n, "cache entries", r.URL.RawQuery)
+		writeJSON(w, http.StatusOK, struct {
+			Purged int `json:"purged"`
+		}{n})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func adminLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || u.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp := struct {
+		Status   string          `json:"status"`
+		Host     *cacheEntryInfo `json:"host"`
+		Endpoint *cacheEntryInfo `json:"endpoint"`
+	}{Status: endpointStatuses[getEndpointStatus(u)]}
+	if info, found := endpointCache.lookupInfo("host:" + getHost(u)); found {
+		resp.Host = &info
+	}
+	if info, found := endpointCache.lookupInfo(u.String()); found {
+		resp.Endpoint = &info
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
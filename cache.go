@@ -1,18 +1,23 @@
 package main
 
 import (
+	"container/list"
+	"log"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/patrickmn/go-cache"
+	"codeberg.org/UnifiedPush/common-proxies/config"
+	"codeberg.org/UnifiedPush/common-proxies/events"
 )
 
-var endpointCache *cache.Cache
+var endpointCache *boundedCache
 
 func init() {
-	// default expiration time of 1 minute
-	// and purges expired items every minutes
-	endpointCache = cache.New(1*time.Minute, 1*time.Minute)
+	// purges expired items every minutes
+	endpointCache = newBoundedCache()
+	go endpointCache.janitor(1 * time.Minute)
 }
 
 type EndpointStatus = int32
@@ -23,41 +28,471 @@ const (
 	Refused
 )
 
-func getHost(url *url.URL) string {
-	return url.Scheme + "://" + url.Host
+type BreakerState = int32
+
+const (
+	Closed BreakerState = iota
+	Open
+	HalfOpen
+)
+
+// Time given to a probe request to report its result
+// before another one is let through
+const probeTimeout = 30 * time.Second
+
+// A circuit breaker for an endpoint or a host.
+// It opens after FailureThreshold consecutive failures, lets a single
+// probe request through once the cool-down is over, and closes again
+// when the probe succeeds. A failing probe doubles the cool-down.
+type breaker struct {
+	state    BreakerState
+	failures int
+	// status returned while the breaker is open, and reason, from the last failure
+	status        EndpointStatus
+	reason        string
+	cooldown      time.Duration
+	openUntil     time.Time
+	probeDeadline time.Time
 }
 
-func getEndpointStatus(url *url.URL) EndpointStatus {
-	status, found := endpointCache.Get("host:" + getHost(url))
-	if found {
-		if s, ok := status.(EndpointStatus); ok {
+// Returns the status of the breaker, NotCached if a request can be made
+func (b *breaker) peek(now time.Time) EndpointStatus {
+	switch {
+	case b.state == Open && now.Before(b.openUntil):
+		return b.status
+	case b.state == HalfOpen && now.Before(b.probeDeadline):
+		return b.status
+	}
+	return NotCached
+}
+
+// Like peek, but moves an open breaker whose cool-down is over to half-open:
+// the caller is then the probe
+func (b *breaker) allow(now time.Time) EndpointStatus {
+	if s := b.peek(now); s != NotCached {
+		return s
+	}
+	if b.state != Closed {
+		b.state = HalfOpen
+		b.probeDeadline = now.Add(probeTimeout)
+	}
+	return NotCached
+}
+
+func (b *breaker) failure(now time.Time, status EndpointStatus, reason string, limits config.CacheConfig) {
+	b.failures++
+	b.status = status
+	b.reason = reason
+	switch {
+	case b.state == HalfOpen:
+		b.open(now, min(b.cooldown*2, limits.MaxCoolDownDuration()))
+	case b.state == Closed && b.failures >= limits.FailureThreshold:
+		b.open(now, limits.CoolDownDuration())
+	}
+}
+
+// Ends a probe without a result: the breaker opens again for the same cool-down
+func (b *breaker) abort(now time.Time) {
+	if b.state == HalfOpen {
+		b.open(now, b.cooldown)
+	}
+}
+
+func (b *breaker) open(now time.Time, cooldown time.Duration) {
+	b.state = Open
+	b.cooldown = cooldown
+	b.openUntil = now.Add(cooldown)
+}
+
+// Rough per entry overhead: list element, map bucket and the entry itself
+const cacheEntryOverhead = 160
+
+type cacheEntry struct {
+	key     string
+	host    string // empty for host entries
+	breaker breaker
+	expires time.Time
+	// the last failure of the endpoint was transient, it counts toward
+	// the aggregation of its host
+	transient bool
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key)+len(e.host)) + cacheEntryOverhead
+}
+
+type cacheStats struct {
+	Entries      int    `json:"entries"`
+	Memory       int64  `json:"memory"`
+	Evictions    uint64 `json:"evictions"`
+	Expirations  uint64 `json:"expirations"`
+	Aggregations uint64 `json:"aggregations"`
+}
+
+// An LRU of circuit breakers bounded by number of entries and estimated memory.
+// Only breakers with failures are stored, a success removes the entry.
+// When too many endpoints of a single host fail transiently, they are
+// replaced by a single open host breaker.
+type boundedCache struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	// number of transient endpoint entries per host
+	hosts map[string]int
+	stats cacheStats
+}
+
+func newBoundedCache() *boundedCache {
+	return &boundedCache{
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+		hosts: map[string]int{},
+	}
+}
+
+// Returns the live entry for key, nil if missing or expired
+func (c *boundedCache) lookup(key string, now time.Time) *cacheEntry {
+	el, found := c.items[key]
+	if !found {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if now.After(e.expires) {
+		c.remove(el)
+		c.stats.Expirations++
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	return e
+}
+
+func (c *boundedCache) get(key string) (EndpointStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e := c.lookup(key, now)
+	if e == nil {
+		return NotCached, false
+	}
+	return e.breaker.peek(now), true
+}
+
+// Returns NotCached if a request to the endpoint key of host can be made,
+// the status of the first open breaker otherwise
+func (c *boundedCache) allow(key string, host string) EndpointStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	hostEntry := c.lookup("host:"+host, now)
+	if hostEntry != nil {
+		if s := hostEntry.breaker.peek(now); s != NotCached {
 			return s
 		}
 	}
-	status, found = endpointCache.Get(url.String())
-	if found {
-		if s, ok := status.(EndpointStatus); ok {
+	if e := c.lookup(key, now); e != nil {
+		if s := e.breaker.allow(now); s != NotCached {
 			return s
 		}
 	}
+	if hostEntry != nil {
+		return hostEntry.breaker.allow(now)
+	}
 	return NotCached
 }
 
-func cacheStatus(id string, status EndpointStatus) {
-	dur := cache.DefaultExpiration
-	// Cache for 10 minutes if the endpoint is refused
-	if status == Refused {
-		dur = 10 * time.Minute
+// Records a failure for key, host is the host key the entry is aggregated under,
+// empty for host entries
+func (c *boundedCache) failure(key string, host string, status EndpointStatus, reason string) {
+	limits := config.Config.Cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e := c.lookup(key, now)
+	if e == nil {
+		e = c.insert(key, host, now)
+	}
+	wasRefused := e.breaker.peek(now) == Refused
+	e.breaker.failure(now, status, reason, limits)
+	if !wasRefused && e.breaker.peek(now) == Refused {
+		e.emit(events.EndpointRefused)
+	}
+	c.setTransient(e, status == TemporaryUnavailable)
+	c.touch(e, now, limits)
+	c.enforce(e, limits)
+}
+
+// Ends the probe of key, if any, without a result
+func (c *boundedCache) abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.items[key]; found {
+		el.Value.(*cacheEntry).breaker.abort(time.Now())
+	}
+}
+
+// Closes the breaker of key
+func (c *boundedCache) success(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.items[key]; found {
+		e := el.Value.(*cacheEntry)
+		if e.breaker.state != Closed && e.breaker.status == Refused {
+			e.emit(events.EndpointRecovered)
+		}
+		c.remove(el)
+	}
+}
+
+func (e *cacheEntry) emit(eventType string) {
+	ev := events.Event{Type: eventType, Endpoint: e.key, Host: e.host}
+	if host, isHost := strings.CutPrefix(e.key, "host:"); isHost {
+		ev.Endpoint = ""
+		ev.Host = host
 	}
-	endpointCache.Set(id, status, dur)
+	if eventType == events.EndpointRefused {
+		ev.Reason = e.breaker.reason
+	}
+	events.Emit(ev)
+}
+
+func (c *boundedCache) insert(key string, host string, now time.Time) *cacheEntry {
+	e := &cacheEntry{key: key, host: host}
+	c.items[key] = c.ll.PushFront(e)
+	c.stats.Memory += e.size()
+	return e
+}
+
+// Counts the endpoint entry e toward the aggregation of its host if its last
+// failure was transient. Gone endpoints never count: anyone can make a push
+// server answer 404 with random endpoints
+func (c *boundedCache) setTransient(e *cacheEntry, transient bool) {
+	if e.host == "" || e.transient == transient {
+		return
+	}
+	e.transient = transient
+	if transient {
+		c.hosts[e.host]++
+	} else {
+		c.uncount(e.host)
+	}
+}
+
+func (c *boundedCache) uncount(host string) {
+	c.hosts[host]--
+	if c.hosts[host] <= 0 {
+		delete(c.hosts, host)
+	}
+}
+
+// Failures are forgotten after the max cool-down
+func (c *boundedCache) touch(e *cacheEntry, now time.Time, limits config.CacheConfig) {
+	from := now
+	if e.breaker.openUntil.After(now) {
+		from = e.breaker.openUntil
+	}
+	e.expires = from.Add(limits.MaxCoolDownDuration())
+}
+
+// Aggregates the host of e if needed, and evicts the least recently used entries
+func (c *boundedCache) enforce(e *cacheEntry, limits config.CacheConfig) {
+	if e.host != "" && limits.HostThreshold > 0 && c.hosts[e.host] >= limits.HostThreshold {
+		c.aggregate(e.host, limits)
+	}
+	for c.ll.Len() > 0 &&
+		((limits.MaxEntries > 0 && c.ll.Len() > limits.MaxEntries) ||
+			(limits.MaxMemory > 0 && c.stats.Memory > limits.MaxMemory)) {
+		c.remove(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Replaces the transient endpoint entries of host by an open host breaker,
+// the breakers of gone endpoints are kept.
+// The host is only considered temporary unavailable.
+func (c *boundedCache) aggregate(host string, limits config.CacheConfig) {
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); e.host == host && e.transient {
+			c.remove(el)
+		}
+		el = next
+	}
+	now := time.Now()
+	e := c.lookup("host:"+host, now)
+	if e == nil {
+		e = c.insert("host:"+host, "", now)
+	}
+	if e.breaker.peek(now) != NotCached {
+		return
+	}
+	e.breaker.status = TemporaryUnavailable
+	e.breaker.open(now, limits.CoolDownDuration())
+	c.touch(e, now, limits)
+	c.stats.Aggregations++
+	log.Println("cache: too many failing endpoints for", host, ", opening host breaker")
+}
+
+func (c *boundedCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.stats.Memory -= e.size()
+	if e.transient {
+		c.uncount(e.host)
+	}
+}
+
+func (c *boundedCache) deleteExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if now.After(el.Value.(*cacheEntry).expires) {
+			c.remove(el)
+			c.stats.Expirations++
+		}
+		el = next
+	}
+}
+
+func (c *boundedCache) getStats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.ll.Len()
+	return s
+}
+
+type cacheEntryInfo struct {
+	Key       string     `json:"key"`
+	Host      string     `json:"host,omitempty"`
+	State     string     `json:"state"`
+	Status    string     `json:"status"`
+	Failures  int        `json:"failures"`
+	Reason    string     `json:"reason,omitempty"`
+	OpenUntil *time.Time `json:"openUntil,omitempty"`
+	Expires   time.Time  `json:"expires"`
+}
+
+var breakerStates = map[BreakerState]string{Closed: "closed", Open: "open", HalfOpen: "half-open"}
+var endpointStatuses = map[EndpointStatus]string{NotCached: "available", TemporaryUnavailable: "temporary unavailable", Refused: "refused"}
+
+func (e *cacheEntry) info(now time.Time) cacheEntryInfo {
+	info := cacheEntryInfo{
+		Key:      e.key,
+		Host:     e.host,
+		State:    breakerStates[e.breaker.state],
+		Status:   endpointStatuses[e.breaker.peek(now)],
+		Failures: e.breaker.failures,
+		Reason:   e.breaker.reason,
+		Expires:  e.expires,
+	}
+	if e.breaker.state == Open {
+		openUntil := e.breaker.openUntil
+		info.OpenUntil = &openUntil
+	}
+	return info
+}
+
+// Returns the live entries, most recently used first.
+// If host is not empty, only the host entry and its endpoints are returned
+func (c *boundedCache) entries(host string) []cacheEntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	out := []cacheEntryInfo{}
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		if now.After(e.expires) {
+			continue
+		}
+		if host != "" && e.host != host && e.key != "host:"+host {
+			continue
+		}
+		out = append(out, e.info(now))
+	}
+	return out
+}
+
+func (c *boundedCache) lookupInfo(key string) (cacheEntryInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	el, found := c.items[key]
+	if !found || now.After(el.Value.(*cacheEntry).expires) {
+		return cacheEntryInfo{}, false
+	}
+	return el.Value.(*cacheEntry).info(now), true
+}
+
+// Removes the entries matching f, and returns how many were removed
+func (c *boundedCache) purge(f func(e *cacheEntry) bool) (n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if f(el.Value.(*cacheEntry)) {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return
+}
+
+func (c *boundedCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	var lastEvictions uint64
+	for range ticker.C {
+		c.deleteExpired()
+		s := c.getStats()
+		if s.Evictions != lastEvictions {
+			logV("cache:", s.Entries, "entries,", s.Memory, "bytes,", s.Evictions-lastEvictions, "evictions since last purge")
+			lastEvictions = s.Evictions
+		}
+	}
+}
+
+func getHost(url *url.URL) string {
+	return url.Scheme + "://" + url.Host
+}
+
+// Returns the status of the open breaker of the host or the endpoint,
+// NotCached if a request can be made
+func getEndpointStatus(url *url.URL) EndpointStatus {
+	if s, _ := endpointCache.get("host:" + getHost(url)); s != NotCached {
+		return s
+	}
+	s, _ := endpointCache.get(url.String())
+	return s
+}
+
+// Like getEndpointStatus, but the caller becomes the probe
+// of breakers whose cool-down is over
+func allowEndpoint(url *url.URL) EndpointStatus {
+	return endpointCache.allow(url.String(), getHost(url))
+}
+
+func endpointFailure(url *url.URL, status EndpointStatus, reason string) {
+	endpointCache.failure(url.String(), getHost(url), status, reason)
+}
+
+// The suffix "host:" avoid considering a cached endpoint
+// as a host endpoint
+func hostFailure(url *url.URL, status EndpointStatus, reason string) {
+	endpointCache.failure("host:"+getHost(url), "", status, reason)
+}
+
+func hostSuccess(url *url.URL) {
+	endpointCache.success("host:" + getHost(url))
 }
 
-func setEndpointStatus(url *url.URL, status EndpointStatus) {
-	cacheStatus(url.String(), status)
+func endpointSuccess(url *url.URL) {
+	endpointCache.success("host:" + getHost(url))
+	endpointCache.success(url.String())
 }
 
-func setHostStatus(url *url.URL, status EndpointStatus) {
-	// The suffix "host:" avoid considering a cached endpoint
-	// as a host endpoint
-	cacheStatus("host:"+getHost(url), status)
+// Ends the probe of the endpoint when the request failed because of its host
+func endpointAbort(url *url.URL) {
+	endpointCache.abort(url.String())
 }
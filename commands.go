@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	. "codeberg.org/UnifiedPush/common-proxies/config"
+	"codeberg.org/UnifiedPush/common-proxies/gateway"
+)
+
+// Subcommands of the binary: common-proxies <command> [flags]
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"sign":      {"Sign a gateway URL for an endpoint", signCommand},
+	"test-push": {"Send an encrypted test message to an endpoint, directly or through a local handler", testPushCommand},
+	"vapid":     {"Generate and inspect VAPID keys, mint and verify VAPID JWTs", vapidCommand},
+}
+
+// Runs the subcommand in os.Args if there is one, returns false otherwise
+func runCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		return false
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return true
+}
+
+func commandsUsage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(flag.CommandLine.Output(), "\nCommands:")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n    \t%s\n", name, commands[name].usage)
+	}
+}
+
+func signCommand(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	configFile := flags.String("c", "config.toml", "path to toml file for config")
+	gw := flags.String("gateway", "generic", "gateway to sign for: generic or aesgcm")
+	base := flags.String("url", "", "public URL of the gateway, for instance https://gateway.example.org/generic/")
+	endpoint := flags.String("e", "", "push endpoint")
+	ttl := flags.Duration("ttl", 0, "validity of the signed URL, 0 never expires")
+	flags.Parse(args)
+
+	if *base == "" || *endpoint == "" {
+		flags.Usage()
+		return errors.New("-url and -e are required")
+	}
+	if err := ParseConf(*configFile); err != nil {
+		return err
+	}
+
+	var signing gateway.SignedURLs
+	switch *gw {
+	case "generic":
+		signing = Config.Gateway.Generic.Signing
+	case "aesgcm":
+		signing = Config.Gateway.Aesgcm.Signing
+	default:
+		return fmt.Errorf("Unknown gateway %s", *gw)
+	}
+	var exp time.Time
+	if *ttl > 0 {
+		exp = time.Now().Add(*ttl)
+	}
+	signed, err := signing.Sign(*base, *endpoint, exp)
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}
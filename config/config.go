@@ -9,9 +9,12 @@ import (
 	"log"
 	"os"
 	"sync"
+	"time"
 
+	"codeberg.org/UnifiedPush/common-proxies/events"
 	"codeberg.org/UnifiedPush/common-proxies/gateway"
 	"codeberg.org/UnifiedPush/common-proxies/rewrite"
+	"codeberg.org/UnifiedPush/common-proxies/utils"
 	"github.com/caarlos0/env/v6"
 	"github.com/komkom/toml"
 )
@@ -28,11 +31,23 @@ type Configuration struct {
 	Verbose     bool   `env:"UP_VERBOSE"`
 	UserAgentID string `env:"UP_UAID"`
 
+	Cache CacheConfig
+
+	Admin AdminConfig
+
+	Retry RetryConfig
+
+	Events struct {
+		Webhook events.Webhook
+	}
+
 	Gateway struct {
-		AllowedHosts []string `env:"UP_GATEWAY_ALLOWEDHOSTS"`
-		Matrix       gateway.Matrix
-		Generic      gateway.Generic
-		Aesgcm       gateway.Aesgcm
+		AllowedHosts   []string `env:"UP_GATEWAY_ALLOWEDHOSTS"`
+		TrustedProxies []string `env:"UP_GATEWAY_TRUSTED_PROXIES"` // IPs or CIDRs
+		MaxTTL         int      `env:"UP_GATEWAY_MAX_TTL"`         // seconds
+		Matrix         gateway.Matrix
+		Generic        gateway.Generic
+		Aesgcm         gateway.Aesgcm
 	}
 
 	Rewrite struct {
@@ -41,6 +56,103 @@ type Configuration struct {
 	}
 }
 
+// Limits of the endpoint status cache and its circuit breakers
+type CacheConfig struct {
+	MaxEntries       int   `env:"UP_CACHE_MAX_ENTRIES"`
+	MaxMemory        int64 `env:"UP_CACHE_MAX_MEMORY"`
+	HostThreshold    int   `env:"UP_CACHE_HOST_THRESHOLD"`
+	FailureThreshold int   `env:"UP_CACHE_FAILURE_THRESHOLD"`
+	CoolDown         int   `env:"UP_CACHE_COOLDOWN"`     // seconds
+	MaxCoolDown      int   `env:"UP_CACHE_MAX_COOLDOWN"` // seconds
+}
+
+func (c CacheConfig) CoolDownDuration() time.Duration {
+	return time.Duration(c.CoolDown) * time.Second
+}
+
+func (c CacheConfig) MaxCoolDownDuration() time.Duration {
+	return time.Duration(c.MaxCoolDown) * time.Second
+}
+
+func (c *CacheConfig) Defaults() (failed bool) {
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 100000
+	}
+	if c.MaxMemory <= 0 {
+		c.MaxMemory = 16 << 20 // 16 MiB
+	}
+	if c.HostThreshold == 0 {
+		c.HostThreshold = 100
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 3
+	}
+	if c.CoolDown <= 0 {
+		c.CoolDown = 60
+	}
+	if c.MaxCoolDown < c.CoolDown {
+		c.MaxCoolDown = utils.Max(600, c.CoolDown)
+	}
+	return
+}
+
+// Admin API listener, disabled if ListenAddr is empty
+type AdminConfig struct {
+	ListenAddr string `env:"UP_ADMIN_LISTEN"`
+	Token      string `env:"UP_ADMIN_TOKEN"`
+}
+
+func (c *AdminConfig) Defaults() (failed bool) {
+	if c.ListenAddr != "" && len(c.Token) < 16 {
+		log.Println("Admin token must be at least 16 characters long")
+		failed = true
+	}
+	return
+}
+
+// Retries of the requests of the rewrite proxies to push servers
+type RetryConfig struct {
+	MaxAttempts int     `env:"UP_RETRY_MAX_ATTEMPTS"` // 1 disables retries
+	BaseDelay   int     `env:"UP_RETRY_BASE_DELAY"`   // milliseconds
+	MaxDelay    int     `env:"UP_RETRY_MAX_DELAY"`    // milliseconds
+	Budget      float64 `env:"UP_RETRY_BUDGET"`       // retries per request, per handler
+	Timeout     int     `env:"UP_RETRY_TIMEOUT"`      // milliseconds, to send a message with its retries
+}
+
+func (c RetryConfig) BaseDelayDuration() time.Duration {
+	return time.Duration(c.BaseDelay) * time.Millisecond
+}
+
+func (c RetryConfig) MaxDelayDuration() time.Duration {
+	return time.Duration(c.MaxDelay) * time.Millisecond
+}
+
+func (c RetryConfig) TimeoutDuration() time.Duration {
+	return time.Duration(c.Timeout) * time.Millisecond
+}
+
+func (c *RetryConfig) Defaults() (failed bool) {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 3
+	}
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = 250
+	}
+	if c.MaxDelay < c.BaseDelay {
+		c.MaxDelay = utils.Max(5000, c.BaseDelay)
+	}
+	if c.Budget < 0 {
+		log.Println("Retry budget cannot be negative")
+		failed = true
+	} else if c.Budget == 0 {
+		c.Budget = 0.2
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10000
+	}
+	return
+}
+
 var ua string
 
 func (c Configuration) GetUserAgent() string {
@@ -78,12 +190,24 @@ func ParseConf(location string) error {
 	}
 	log.Println("Loading new config")
 	Config = config
+	events.Start(Config.Events.Webhook)
 	return nil
 }
 
 func Defaults(c *Configuration) (failed bool) {
 	c.MaxUPSize = 4096 // this forces it to be this, ignoring user config
-	return c.Rewrite.FCM.Defaults() ||
+	if c.Gateway.MaxTTL <= 0 {
+		c.Gateway.MaxTTL = 86400 // Cache for a day max
+	}
+	if err := gateway.SetTrustedProxies(c.Gateway.TrustedProxies); err != nil {
+		log.Println(err)
+		return true
+	}
+	return c.Cache.Defaults() ||
+		c.Admin.Defaults() ||
+		c.Retry.Defaults() ||
+		c.Events.Webhook.Defaults() ||
+		c.Rewrite.FCM.Defaults() ||
 		c.Rewrite.WebPushFCM.Defaults() ||
 		c.Gateway.Matrix.Defaults() ||
 		c.Gateway.Generic.Defaults() ||
@@ -0,0 +1,155 @@
+package ece
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Default record size of the messages we encrypt
+const DefaultRecordSize = 4096
+
+// Encryption parameters. The zero value encrypts in records of
+// DefaultRecordSize bytes, without padding, with a random salt and sender key
+type Options struct {
+	RecordSize uint32
+	// Number of padding bytes added to the plaintext, to hide its length
+	Padding int
+	// Fixed salt and sender key, for tests only
+	Salt    []byte
+	Private *ecdh.PrivateKey
+}
+
+func (o Options) recordSize() uint32 {
+	if o.RecordSize == 0 {
+		return DefaultRecordSize
+	}
+	return o.RecordSize
+}
+
+func (o Options) salt() ([]byte, error) {
+	if o.Salt != nil {
+		if len(o.Salt) != SaltLen {
+			return nil, fmt.Errorf("salt must be %d bytes", SaltLen)
+		}
+		return o.Salt, nil
+	}
+	salt := make([]byte, SaltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+func (o Options) private() (*ecdh.PrivateKey, error) {
+	if o.Private != nil {
+		return o.Private, nil
+	}
+	return ecdh.P256().GenerateKey(rand.Reader)
+}
+
+// RFC 8188 2.2 and 2.3: derives the content encryption key and the nonce
+func aes128gcmKeys(ikm, salt []byte) (cek, nonce []byte) {
+	prk := hkdfExtract(salt, ikm)
+	return hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16),
+		hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+}
+
+// Encrypts plaintext to an RFC 8188 aes128gcm payload, with the input keying
+// material ikm. keyID is written in the header
+func Encrypt(plaintext, ikm, keyID []byte, opts Options) ([]byte, error) {
+	rs := opts.recordSize()
+	// A record contains at least a byte of data or padding, the delimiter and the tag
+	if rs < TagLen+2 {
+		return nil, fmt.Errorf("aes128gcm: record size is too small: %d", rs)
+	}
+	if len(keyID) > 255 {
+		return nil, errors.New("aes128gcm: key id is longer than 255 bytes")
+	}
+	if opts.Padding < 0 {
+		return nil, errors.New("aes128gcm: padding cannot be negative")
+	}
+	salt, err := opts.salt()
+	if err != nil {
+		return nil, err
+	}
+	cek, nonce := aes128gcmKeys(ikm, salt)
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	body := append([]byte{}, salt...)
+	body = binary.BigEndian.AppendUint32(body, rs)
+	body = append(body, byte(len(keyID)))
+	body = append(body, keyID...)
+
+	// Data and padding of each record, all records but the last one are full.
+	// The padding goes first, as in RFC 8188 3.2
+	capacity := int(rs) - TagLen - 1
+	data, padding := plaintext, opts.Padding
+	for seq := uint64(0); ; seq++ {
+		p := min(capacity, padding)
+		d := min(capacity-p, len(data))
+		last := d == len(data) && p == padding
+		record := make([]byte, d+1+p)
+		copy(record, data[:d])
+		// 0x02 delimits the last record, 0x01 the others
+		record[d] = 1
+		if last {
+			record[d] = 2
+		}
+		body = gcm.Seal(body, recordNonce(nonce, seq), record, nil)
+		if last {
+			return body, nil
+		}
+		data, padding = data[d:], padding-p
+	}
+}
+
+// Decrypts an RFC 8188 aes128gcm payload with the input keying material ikm
+func Decrypt(body, ikm []byte) ([]byte, error) {
+	h, n, err := ParseHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	return decryptRecords(h, body[n:], ikm)
+}
+
+func decryptRecords(h *Header, records, ikm []byte) ([]byte, error) {
+	cek, nonce := aes128gcmKeys(ikm, h.Salt)
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("aes128gcm: payload has no record")
+	}
+	var plaintext []byte
+	rs := int(h.RecordSize)
+	for seq := uint64(0); len(records) > 0; seq++ {
+		n := min(rs, len(records))
+		record, err := gcm.Open(nil, recordNonce(nonce, seq), records[:n], nil)
+		if err != nil {
+			return nil, fmt.Errorf("aes128gcm: cannot decrypt the record %d", seq)
+		}
+		records = records[n:]
+		// Removes the padding, then the delimiter
+		i := len(record) - 1
+		for i >= 0 && record[i] == 0 {
+			i--
+		}
+		switch {
+		case i < 0:
+			return nil, fmt.Errorf("aes128gcm: record %d has no delimiter", seq)
+		case record[i] == 2 && len(records) > 0:
+			return nil, fmt.Errorf("aes128gcm: record %d is the last one, but is followed by more records", seq)
+		case record[i] == 1 && len(records) == 0:
+			return nil, errors.New("aes128gcm: payload is truncated")
+		case record[i] != 1 && record[i] != 2:
+			return nil, fmt.Errorf("aes128gcm: record %d has an invalid delimiter", seq)
+		}
+		plaintext = append(plaintext, record[:i]...)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,51 @@
+package ece
+
+import (
+	"bytes"
+	"testing"
+)
+
+// RFC 8188 3.1 and 3.2
+var rfc8188Vectors = []struct {
+	key     string
+	opts    Options
+	keyID   string
+	payload string
+}{
+	{"yqdlZ-tYemfogSmv7Ws5PQ", Options{}, "", "I1BsxtFttlv3u_Oo94xnmwAAEAAA-NAVub2qFgBEuQKRapoZu-IxkIva3MEB1PD-ly8Thjg"},
+	{"BO3ZVPxUlnLORbVGMpbT1Q", Options{RecordSize: 25, Padding: 1}, "a1", "uNCkWiNYzKTnBN9ji3-qWAAAABkCYTHOG8chz_gnvgOqdGYovxyjuqRyJFjEDyoF1Fvkj6hQPdPHI51OEUKEpgz3SsLWIqS_uA"},
+}
+
+func TestRFC8188(t *testing.T) {
+	for _, v := range rfc8188Vectors {
+		key, _ := decodeBase64(v.key)
+		payload, _ := decodeBase64(v.payload)
+		plaintext, err := Decrypt(payload, key)
+		if err != nil {
+			t.Fatalf("%s: %s", v.key, err)
+		}
+		if string(plaintext) != "I am the walrus" {
+			t.Fatalf("%s: unexpected plaintext: %q", v.key, plaintext)
+		}
+		v.opts.Salt = payload[:SaltLen]
+		encrypted, err := Encrypt(plaintext, key, []byte(v.keyID), v.opts)
+		if err != nil {
+			t.Fatalf("%s: %s", v.key, err)
+		}
+		if !bytes.Equal(encrypted, payload) {
+			t.Fatalf("%s: unexpected payload", v.key)
+		}
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	v := rfc8188Vectors[1]
+	key, _ := decodeBase64(v.key)
+	payload, _ := decodeBase64(v.payload)
+	if _, err := Decrypt(payload[:len(payload)-25], key); err == nil {
+		t.Fatal("Truncated payload should not be decrypted")
+	}
+	if _, err := Decrypt(payload, key[1:]); err == nil {
+		t.Fatal("Payload should not be decrypted with another key")
+	}
+}
@@ -0,0 +1,281 @@
+package ece
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Default record size of aesgcm, when rs is missing
+const AesgcmRecordSize = 4096
+
+// The draft-ietf-webpush-encryption-04 "aesgcm" headers, resolved to the key
+// used to encrypt the payload
+type AesgcmHeaders struct {
+	Salt       []byte
+	RecordSize uint32
+	// The uncompressed P-256 public key of the sender
+	DH []byte
+	// The VAPID public key, if any
+	P256ECDSA []byte
+}
+
+// Parses a header value made of comma separated entries of
+// semicolon separated parameters:
+//
+//	keyid=a; dh=BASE64, keyid=b; p256ecdsa="BASE64"
+//
+// Parameter names are lowercased, and quoted values unquoted
+func ParseParams(value string) ([]map[string]string, error) {
+	var entries []map[string]string
+	for _, entry := range splitQuoted(value, ',') {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		params := map[string]string{}
+		for _, param := range splitQuoted(entry, ';') {
+			if strings.TrimSpace(param) == "" {
+				continue
+			}
+			name, val, ok := strings.Cut(param, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !ok || name == "" {
+				return nil, fmt.Errorf("Invalid parameter: %s", strings.TrimSpace(param))
+			}
+			val = strings.TrimSpace(val)
+			if strings.HasPrefix(val, `"`) {
+				unquoted, err := strconv.Unquote(val)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid quoted value for %s: %s", name, val)
+				}
+				val = unquoted
+			}
+			if _, ok := params[name]; ok {
+				return nil, fmt.Errorf("Duplicate parameter: %s", name)
+			}
+			params[name] = val
+		}
+		entries = append(entries, params)
+	}
+	return entries, nil
+}
+
+// Splits s at each sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Decodes base64url, padded or not. Standard base64 is accepted too, some
+// old clients use it
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// Parses the Encryption and Crypto-Key headers of an aesgcm request.
+//
+// The first Encryption entry is used. If it has a keyid, the dh is taken from
+// the Crypto-Key entry with the same keyid, else from the only Crypto-Key
+// entry with a dh.
+func ParseAesgcmHeaders(encryption string, cryptoKey string) (*AesgcmHeaders, error) {
+	encEntries, err := ParseParams(encryption)
+	if err != nil {
+		return nil, fmt.Errorf("aesgcm: Encryption: %w", err)
+	}
+	if len(encEntries) == 0 {
+		return nil, errors.New("aesgcm: Encryption header is missing")
+	}
+	enc := encEntries[0]
+	h := &AesgcmHeaders{RecordSize: AesgcmRecordSize}
+	if h.Salt, err = decodeBase64(enc["salt"]); err != nil || len(h.Salt) != SaltLen {
+		return nil, fmt.Errorf("aesgcm: salt must be %d bytes, base64url encoded", SaltLen)
+	}
+	if val, ok := enc["rs"]; ok {
+		rs, err := strconv.ParseUint(val, 10, 32)
+		// A record contains at least the 2 bytes padding length
+		if err != nil || rs < 2 {
+			return nil, fmt.Errorf("aesgcm: invalid record size: %s", val)
+		}
+		h.RecordSize = uint32(rs)
+	}
+
+	keyEntries, err := ParseParams(cryptoKey)
+	if err != nil {
+		return nil, fmt.Errorf("aesgcm: Crypto-Key: %w", err)
+	}
+	var dh string
+	keyid, hasKeyid := enc["keyid"]
+	for _, entry := range keyEntries {
+		if val, ok := entry["p256ecdsa"]; ok && h.P256ECDSA == nil {
+			if h.P256ECDSA, err = decodeBase64(val); err != nil {
+				return nil, errors.New("aesgcm: p256ecdsa is not base64url encoded")
+			}
+		}
+		val, ok := entry["dh"]
+		if !ok || (hasKeyid && entry["keyid"] != keyid) {
+			continue
+		}
+		if dh != "" {
+			return nil, errors.New("aesgcm: Crypto-Key has multiple dh, a keyid is needed")
+		}
+		dh = val
+	}
+	if dh == "" {
+		if hasKeyid {
+			return nil, fmt.Errorf("aesgcm: no Crypto-Key dh for the keyid %s", keyid)
+		}
+		return nil, errors.New("aesgcm: Crypto-Key dh is missing")
+	}
+	if h.DH, err = decodeBase64(dh); err != nil {
+		return nil, errors.New("aesgcm: dh is not base64url encoded")
+	}
+	if _, err := ecdh.P256().NewPublicKey(h.DH); err != nil {
+		return nil, fmt.Errorf("aesgcm: dh is not a P-256 public key: %w", err)
+	}
+	return h, nil
+}
+
+// Returns the normalized Encryption header
+func (h AesgcmHeaders) Encryption() string {
+	s := `salt="` + base64.RawURLEncoding.EncodeToString(h.Salt) + `"`
+	if h.RecordSize != AesgcmRecordSize {
+		s += "; rs=" + strconv.FormatUint(uint64(h.RecordSize), 10)
+	}
+	return s
+}
+
+// Returns the normalized Crypto-Key header, with only the dh
+func (h AesgcmHeaders) CryptoKey() string {
+	return `dh="` + base64.RawURLEncoding.EncodeToString(h.DH) + `"`
+}
+
+// draft-ietf-httpbis-encryption-encoding-03 4.2: derives the content
+// encryption key and the nonce of an aesgcm message
+func aesgcmKeys(secret, auth, uaPublic, asPublic, salt []byte) (cek, nonce []byte) {
+	ikm := hkdfExpand(hkdfExtract(auth, secret), []byte("Content-Encoding: auth\x00"), 32)
+	context := []byte("P-256\x00")
+	context = binary.BigEndian.AppendUint16(context, uint16(len(uaPublic)))
+	context = append(context, uaPublic...)
+	context = binary.BigEndian.AppendUint16(context, uint16(len(asPublic)))
+	context = append(context, asPublic...)
+	prk := hkdfExtract(salt, ikm)
+	return hkdfExpand(prk, append([]byte("Content-Encoding: aesgcm\x00"), context...), 16),
+		hkdfExpand(prk, append([]byte("Content-Encoding: nonce\x00"), context...), 12)
+}
+
+// Encrypts plaintext in an aesgcm message for the receiver uaPublic.
+// Returns the headers to send with the body
+func EncryptAesgcm(plaintext []byte, uaPublic *ecdh.PublicKey, auth []byte, opts Options) (*AesgcmHeaders, []byte, error) {
+	rs := opts.recordSize()
+	// A record contains at least the padding length and a byte of data or padding
+	if rs < 3 {
+		return nil, nil, fmt.Errorf("aesgcm: record size is too small: %d", rs)
+	}
+	if opts.Padding < 0 {
+		return nil, nil, errors.New("aesgcm: padding cannot be negative")
+	}
+	asPrivate, err := opts.private()
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &AesgcmHeaders{RecordSize: rs, DH: asPrivate.PublicKey().Bytes()}
+	if h.Salt, err = opts.salt(); err != nil {
+		return nil, nil, err
+	}
+	cek, nonce := aesgcmKeys(secret, auth, uaPublic.Bytes(), h.DH, h.Salt)
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body []byte
+	capacity := int(rs) - 2
+	data, padding := plaintext, opts.Padding
+	// A message ending with a full record could have been truncated,
+	// so it is followed by an empty record
+	for seq, full := uint64(0), true; len(data) > 0 || padding > 0 || full; seq++ {
+		p := min(capacity, padding, 0xffff)
+		d := min(capacity-p, len(data))
+		record := make([]byte, 2+p+d)
+		binary.BigEndian.PutUint16(record, uint16(p))
+		copy(record[2+p:], data[:d])
+		body = gcm.Seal(body, recordNonce(nonce, seq), record, nil)
+		data, padding = data[d:], padding-p
+		full = len(record) == int(rs)
+	}
+	return h, body, nil
+}
+
+// Decrypts an aesgcm message, with the headers h, received with keys
+func DecryptAesgcm(h *AesgcmHeaders, body []byte, keys Keys) ([]byte, error) {
+	if err := ValidateAesgcm(h, body); err != nil {
+		return nil, err
+	}
+	asPublic, err := ecdh.P256().NewPublicKey(h.DH)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := keys.Private.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	cek, nonce := aesgcmKeys(secret, keys.Auth, keys.Public(), h.DH, h.Salt)
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext []byte
+	size := int(h.RecordSize) + TagLen
+	for seq := uint64(0); len(body) > 0; seq++ {
+		n := min(size, len(body))
+		record, err := gcm.Open(nil, recordNonce(nonce, seq), body[:n], nil)
+		if err != nil {
+			return nil, fmt.Errorf("aesgcm: cannot decrypt the record %d", seq)
+		}
+		// 2 bytes of padding length, then the padding
+		if len(record) < 2 {
+			return nil, errors.New("aesgcm: record is too short")
+		}
+		pad := int(binary.BigEndian.Uint16(record))
+		if 2+pad > len(record) {
+			return nil, errors.New("aesgcm: invalid padding")
+		}
+		for _, b := range record[2 : 2+pad] {
+			if b != 0 {
+				return nil, errors.New("aesgcm: invalid padding")
+			}
+		}
+		plaintext = append(plaintext, record[2+pad:]...)
+		body = body[n:]
+		if len(body) == 0 && n == size {
+			return nil, errors.New("aesgcm: payload is truncated, it ends with a full record")
+		}
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,130 @@
+package ece
+
+import (
+	"crypto/ecdh"
+	"net/http"
+	"testing"
+)
+
+const testDH = "BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU"
+
+func TestParseAesgcmHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption string
+		cryptoKey  string
+		valid      bool
+		normalized string
+	}{
+		{"quoted", `salt="lngarbyKfMoi9Z75xYXmkg"`, `dh="` + testDH + `"`, true, `salt="lngarbyKfMoi9Z75xYXmkg"`},
+		{"token", `salt=lngarbyKfMoi9Z75xYXmkg;rs=24`, `dh=` + testDH, true, `salt="lngarbyKfMoi9Z75xYXmkg"; rs=24`},
+		{"vapid", `salt=lngarbyKfMoi9Z75xYXmkg`, `dh=` + testDH + `;p256ecdsa=` + testDH, true, `salt="lngarbyKfMoi9Z75xYXmkg"`},
+		{"keyid", `keyid=p256dh; salt=lngarbyKfMoi9Z75xYXmkg`, `keyid=other; dh=BAAA, keyid=p256dh; dh=` + testDH, true, `salt="lngarbyKfMoi9Z75xYXmkg"`},
+		{"separate vapid", `salt=lngarbyKfMoi9Z75xYXmkg`, `dh=` + testDH + `, p256ecdsa=` + testDH, true, `salt="lngarbyKfMoi9Z75xYXmkg"`},
+		{"missing keyid", `keyid=a; salt=lngarbyKfMoi9Z75xYXmkg`, `keyid=b; dh=` + testDH, false, ""},
+		{"ambiguous dh", `salt=lngarbyKfMoi9Z75xYXmkg`, `dh=` + testDH + `, dh=` + testDH, false, ""},
+		{"short salt", `salt=lngarbyKfMoi9Z75x`, `dh=` + testDH, false, ""},
+		{"bad rs", `salt=lngarbyKfMoi9Z75xYXmkg; rs=1`, `dh=` + testDH, false, ""},
+		{"bad dh", `salt=lngarbyKfMoi9Z75xYXmkg`, `dh=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHA`, false, ""},
+		{"no dh", `salt=lngarbyKfMoi9Z75xYXmkg`, `p256ecdsa=` + testDH, false, ""},
+		{"no encryption", ``, `dh=` + testDH, false, ""},
+	}
+	for _, test := range tests {
+		h, err := ParseAesgcmHeaders(test.encryption, test.cryptoKey)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: headers should be rejected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if h.Encryption() != test.normalized {
+			t.Errorf("%s: Encryption is %s", test.name, h.Encryption())
+		}
+		if h.CryptoKey() != `dh="`+testDH+`"` {
+			t.Errorf("%s: Crypto-Key is %s", test.name, h.CryptoKey())
+		}
+	}
+}
+
+func TestAesgcmRoundTrip(t *testing.T) {
+	keys := testKeys(t, "9FWl15_QUQAWDaD3k3l50ZBZQJ4au27F1V4F0uLSD_M", "R29vIGdvb2cgYSdqb29iIQ")
+	for _, opts := range []Options{
+		{},
+		{Padding: 20},
+		{RecordSize: 10},
+		{RecordSize: 10, Padding: 7},
+		// Ends on a record boundary
+		{RecordSize: 17},
+	} {
+		h, body, err := EncryptAesgcm([]byte("I am the walrus"), keys.Private.PublicKey(), keys.Auth, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err = ParseAesgcmHeaders(h.Encryption(), h.CryptoKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := DecryptAesgcm(h, body, keys)
+		if err != nil {
+			t.Fatalf("%+v: %s", opts, err)
+		}
+		if string(plaintext) != "I am the walrus" {
+			t.Fatalf("%+v: unexpected plaintext: %q", opts, plaintext)
+		}
+	}
+	h, body, _ := EncryptAesgcm([]byte("I am the walrus"), keys.Private.PublicKey(), keys.Auth, Options{RecordSize: 17})
+	if _, err := DecryptAesgcm(h, body[:len(body)-18], keys); err == nil {
+		t.Fatal("Truncated payload should not be decrypted")
+	}
+	body[0] ^= 1
+	if _, err := DecryptAesgcm(h, body, keys); err == nil {
+		t.Fatal("Altered payload should not be decrypted")
+	}
+}
+
+func testKeys(t *testing.T, private string, auth string) Keys {
+	raw, _ := decodeBase64(private)
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := decodeBase64(auth)
+	return Keys{key, secret}
+}
+
+func TestValidateAesgcm(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Encoding", "aesgcm")
+	header.Set("Encryption", "salt=lngarbyKfMoi9Z75xYXmkg; rs=24")
+	header.Set("Crypto-Key", "dh="+testDH)
+	size := 24 + TagLen
+	for _, test := range []struct {
+		name  string
+		len   int
+		valid bool
+	}{
+		{"single record", TagLen + 2, true},
+		{"several records", 2*size + TagLen + 5, true},
+		{"too short", TagLen + 1, false},
+		{"full last record", 2 * size, false},
+		{"short last record", size + TagLen + 1, false},
+	} {
+		if err := Validate(header, make([]byte, test.len)); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected validation result %v", test.name, err)
+		}
+	}
+
+	header.Set("Crypto-Key", "p256ecdsa="+testDH)
+	if err := Validate(header, make([]byte, TagLen+2)); err == nil {
+		t.Error("aesgcm payloads without dh should be rejected")
+	}
+	header.Del("Encryption")
+	header.Set("Crypto-Key", "dh="+testDH)
+	if err := Validate(header, make([]byte, TagLen+2)); err == nil {
+		t.Error("aesgcm payloads without salt should be rejected")
+	}
+}
@@ -0,0 +1,103 @@
+package ece
+
+import (
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	SaltLen = 16
+	TagLen  = 16
+	// salt, record size and key id length
+	HeaderMinLen = SaltLen + 4 + 1
+	// RFC 8291: the key id is the uncompressed P-256 public key of the sender
+	WebPushKeyIDLen = 65
+)
+
+// RFC 8188 2.1: the header of an aes128gcm payload
+type Header struct {
+	Salt       []byte
+	RecordSize uint32
+	KeyID      []byte
+}
+
+// Parses the header at the beginning of body, and returns it with its length
+func ParseHeader(body []byte) (*Header, int, error) {
+	if len(body) < HeaderMinLen {
+		return nil, 0, errors.New("aes128gcm: payload is shorter than the header")
+	}
+	h := &Header{
+		Salt:       body[:SaltLen],
+		RecordSize: binary.BigEndian.Uint32(body[SaltLen : SaltLen+4]),
+	}
+	// A record contains at least the padding delimiter and the tag
+	if h.RecordSize < TagLen+2 {
+		return nil, 0, fmt.Errorf("aes128gcm: record size is too small: %d", h.RecordSize)
+	}
+	idlen := int(body[SaltLen+4])
+	if len(body) < HeaderMinLen+idlen {
+		return nil, 0, errors.New("aes128gcm: payload is shorter than the key id")
+	}
+	h.KeyID = body[HeaderMinLen : HeaderMinLen+idlen]
+	return h, HeaderMinLen + idlen, nil
+}
+
+// Checks body is an RFC 8291 WebPush message: an aes128gcm payload, with a single
+// record, whose key id is a P-256 public key
+func ValidateWebPush(body []byte) error {
+	h, n, err := ParseHeader(body)
+	if err != nil {
+		return err
+	}
+	if len(h.KeyID) != WebPushKeyIDLen {
+		return fmt.Errorf("aes128gcm: key id must be a %d bytes public key, got %d bytes", WebPushKeyIDLen, len(h.KeyID))
+	}
+	if _, err := ecdh.P256().NewPublicKey(h.KeyID); err != nil {
+		return fmt.Errorf("aes128gcm: key id is not a P-256 public key: %w", err)
+	}
+	records := len(body) - n
+	if records < TagLen+1 {
+		return errors.New("aes128gcm: payload is shorter than a record")
+	}
+	if records > int(h.RecordSize) {
+		return fmt.Errorf("aes128gcm: WebPush payload must be a single record, got %d bytes for a record size of %d", records, h.RecordSize)
+	}
+	return nil
+}
+
+// Checks body is a draft-ietf-webpush-encryption-04 "aesgcm" payload for the
+// headers h, parsed with ParseAesgcmHeaders: records of h.RecordSize with a 2
+// bytes padding length and a tag, the last one shorter than the others
+func ValidateAesgcm(h *AesgcmHeaders, body []byte) error {
+	if len(body) < TagLen+2 {
+		return errors.New("aesgcm: payload is shorter than a record")
+	}
+	size := int(h.RecordSize) + TagLen
+	if last := len(body) % size; last == 0 {
+		return errors.New("aesgcm: payload is truncated, it ends with a full record")
+	} else if last < TagLen+2 {
+		return errors.New("aesgcm: last record is shorter than a record")
+	}
+	return nil
+}
+
+// Checks body is a WebPush payload encrypted with the Content-Encoding of
+// header, aes128gcm if empty. aesgcm payloads are checked against their
+// Encryption and Crypto-Key headers
+func Validate(header http.Header, body []byte) error {
+	switch contentEncoding := header.Get("Content-Encoding"); contentEncoding {
+	case "", "aes128gcm":
+		return ValidateWebPush(body)
+	case "aesgcm":
+		h, err := ParseAesgcmHeaders(header.Get("Encryption"), header.Get("Crypto-Key"))
+		if err != nil {
+			return err
+		}
+		return ValidateAesgcm(h, body)
+	default:
+		return fmt.Errorf("Unsupported Content-Encoding: %s", contentEncoding)
+	}
+}
@@ -0,0 +1,30 @@
+package ece
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	// RFC 8188 3.1
+	body := []byte{
+		0x23, 0x05, 0x0e, 0xa4, 0x6e, 0xf2, 0x59, 0x6a, 0x4b, 0x5a, 0x6f, 0x1f, 0x0a, 0x8a, 0xb4, 0x8e,
+		0x00, 0x00, 0x10, 0x00, 0x00,
+		0xf2, 0x02, 0x66, 0x10, 0xe5, 0x3e, 0x1c, 0x0b, 0x73, 0x37, 0xd9, 0xb2, 0xf1, 0x72, 0x01, 0x40,
+		0x7d, 0x64, 0x6a, 0x09, 0x8c, 0x98, 0x69, 0x6a, 0x76, 0x9c, 0xac, 0xe3, 0x85, 0x0c, 0xc0, 0x64,
+		0x4f, 0xb5, 0xbb, 0x61, 0x64, 0xfa, 0x75, 0xb7, 0xcd, 0x43, 0x27, 0x88, 0x1e, 0x0c, 0x3b, 0x1d,
+	}
+	h, n, err := ParseHeader(body)
+	if err != nil {
+		t.Fatalf("Cannot parse header: %s", err)
+	}
+	if n != HeaderMinLen || h.RecordSize != 4096 || len(h.KeyID) != 0 || !bytes.Equal(h.Salt, body[:16]) {
+		t.Fatalf("Unexpected header: %+v, %d", h, n)
+	}
+	if err := ValidateWebPush(body); err == nil {
+		t.Fatal("Payload without key id should not be a WebPush message")
+	}
+	if _, _, err := ParseHeader(body[:20]); err == nil {
+		t.Fatal("Truncated header should be rejected")
+	}
+}
@@ -0,0 +1,77 @@
+package ece
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// Length of the WebPush authentication secret
+const AuthLen = 16
+
+// The keys of a WebPush receiver: its P-256 private key, and its
+// authentication secret
+type Keys struct {
+	Private *ecdh.PrivateKey
+	Auth    []byte
+}
+
+// Parses keys encoded with Keys.String
+func ParseKeys(s string) (*Keys, error) {
+	raw, err := decodeBase64(s)
+	if err != nil || len(raw) != 32+AuthLen {
+		return nil, errors.New("keys must be the 32 bytes private key and the 16 bytes auth secret, base64url encoded")
+	}
+	private, err := ecdh.P256().NewPrivateKey(raw[:32])
+	if err != nil {
+		return nil, err
+	}
+	return &Keys{private, raw[32:]}, nil
+}
+
+// Returns the base64url encoded private key and auth secret
+func (k Keys) String() string {
+	return base64.RawURLEncoding.EncodeToString(append(k.Private.Bytes(), k.Auth...))
+}
+
+// Returns the uncompressed public key of the receiver, the p256dh of the subscription
+func (k Keys) Public() []byte {
+	return k.Private.PublicKey().Bytes()
+}
+
+// RFC 5869 HKDF-Extract with SHA-256
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// RFC 5869 HKDF-Expand with SHA-256, for at most one hash length
+func hkdfExpand(prk, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the nonce of record seq: the base nonce XORed with seq
+func recordNonce(base []byte, seq uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+	}
+	return nonce
+}
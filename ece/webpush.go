@@ -0,0 +1,46 @@
+package ece
+
+import (
+	"crypto/ecdh"
+	"fmt"
+)
+
+// RFC 8291 3.3 and 3.4: derives the input keying material of the aes128gcm
+// payload from the ECDH secret and the auth secret
+func webPushIKM(secret, auth, uaPublic, asPublic []byte) []byte {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	return hkdfExpand(hkdfExtract(auth, secret), keyInfo, 32)
+}
+
+// Encrypts plaintext in an RFC 8291 WebPush message for the receiver uaPublic.
+// The message must fit in a single record
+func EncryptWebPush(plaintext []byte, uaPublic *ecdh.PublicKey, auth []byte, opts Options) ([]byte, error) {
+	if len(plaintext)+opts.Padding+1+TagLen > int(opts.recordSize()) {
+		return nil, fmt.Errorf("aes128gcm: %d bytes of plaintext and %d bytes of padding don't fit in a record of %d bytes", len(plaintext), opts.Padding, opts.recordSize())
+	}
+	asPrivate, err := opts.private()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	return Encrypt(plaintext, webPushIKM(secret, auth, uaPublic.Bytes(), asPublic), asPublic, opts)
+}
+
+// Decrypts an RFC 8291 WebPush message received with keys
+func DecryptWebPush(body []byte, keys Keys) ([]byte, error) {
+	if err := ValidateWebPush(body); err != nil {
+		return nil, err
+	}
+	h, n, _ := ParseHeader(body)
+	asPublic, _ := ecdh.P256().NewPublicKey(h.KeyID)
+	secret, err := keys.Private.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	return decryptRecords(h, body[n:], webPushIKM(secret, keys.Auth, keys.Public(), h.KeyID))
+}
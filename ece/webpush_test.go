@@ -0,0 +1,55 @@
+package ece
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"testing"
+)
+
+// RFC 8291 appendix A
+const rfc8291Payload = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+
+func TestRFC8291(t *testing.T) {
+	keys := testKeys(t, "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94", "BTBZMqHH6r4Tts7J_aSIgg")
+	payload, _ := decodeBase64(rfc8291Payload)
+	plaintext, err := DecryptWebPush(payload, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "When I grow up, I want to be a watermelon" {
+		t.Fatalf("Unexpected plaintext: %q", plaintext)
+	}
+
+	raw, _ := decodeBase64("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	asPrivate, _ := ecdh.P256().NewPrivateKey(raw)
+	salt, _ := decodeBase64("DGv6ra1nlYgDCS1FRnbzlw")
+	encrypted, err := EncryptWebPush(plaintext, keys.Private.PublicKey(), keys.Auth, Options{Salt: salt, Private: asPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encrypted, payload) {
+		t.Fatal("Unexpected payload")
+	}
+}
+
+func TestWebPushRoundTrip(t *testing.T) {
+	keys := testKeys(t, "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94", "BTBZMqHH6r4Tts7J_aSIgg")
+	body, err := EncryptWebPush([]byte("message"), keys.Private.PublicKey(), keys.Auth, Options{Padding: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateWebPush(body); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := DecryptWebPush(body, keys)
+	if err != nil || !bytes.Equal(plaintext, []byte("message")) {
+		t.Fatalf("Cannot decrypt: %q, %v", plaintext, err)
+	}
+	if _, err := EncryptWebPush(make([]byte, 4000), keys.Private.PublicKey(), keys.Auth, Options{Padding: 100}); err == nil {
+		t.Fatal("Message should fit in a single record")
+	}
+	parsed, err := ParseKeys(keys.String())
+	if err != nil || !bytes.Equal(parsed.Public(), keys.Public()) {
+		t.Fatalf("Cannot parse keys: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EndpointRefused   = "endpoint-refused"
+	EndpointRecovered = "endpoint-recovered"
+)
+
+// An event about a push server endpoint, or a whole push server host
+type Event struct {
+	Type     string    `json:"type"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+type batch struct {
+	Events []Event `json:"events"`
+}
+
+// Sends events in batches to URL, as JSON, signed with Secret.
+// The signature header is "X-UP-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">"
+type Webhook struct {
+	URL           string `env:"UP_EVENTS_WEBHOOK_URL"`
+	Secret        string `env:"UP_EVENTS_WEBHOOK_SECRET"`
+	BatchSize     int    `env:"UP_EVENTS_BATCH_SIZE"`
+	FlushInterval int    `env:"UP_EVENTS_FLUSH_INTERVAL"` // seconds
+	MaxRetries    int    `env:"UP_EVENTS_MAX_RETRIES"`
+}
+
+func (w *Webhook) Defaults() (failed bool) {
+	if w.URL == "" {
+		return
+	}
+	if w.Secret == "" {
+		log.Println("Events webhook secret cannot be empty")
+		failed = true
+	}
+	if w.BatchSize <= 0 {
+		w.BatchSize = 50
+	}
+	if w.FlushInterval <= 0 {
+		w.FlushInterval = 10
+	}
+	if w.MaxRetries < 0 {
+		w.MaxRetries = 0
+	} else if w.MaxRetries == 0 {
+		w.MaxRetries = 3
+	}
+	return
+}
+
+func (w Webhook) Sign(timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+var (
+	lock   sync.RWMutex
+	hook   Webhook
+	queue  chan Event
+	done   chan bool
+	client = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Starts the sink, or updates its configuration if it is already running
+func Start(w Webhook) {
+	lock.Lock()
+	defer lock.Unlock()
+	hook = w
+	if queue == nil && w.URL != "" {
+		queue = make(chan Event, 1024)
+		done = make(chan bool)
+		go run(queue, done)
+	}
+}
+
+// Sends the pending events and stops the sink
+func Stop(timeout time.Duration) {
+	lock.Lock()
+	q, d := queue, done
+	queue = nil
+	lock.Unlock()
+	if q == nil {
+		return
+	}
+	close(q)
+	select {
+	case <-d:
+	case <-time.After(timeout):
+		log.Println("events: pending events dropped on shutdown")
+	}
+}
+
+// Queues e, without blocking. Does nothing if no webhook is configured
+func Emit(e Event) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if queue == nil || hook.URL == "" {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case queue <- e:
+	default:
+		log.Println("events: queue is full, dropping", e.Type, "event")
+	}
+}
+
+func current() Webhook {
+	lock.RLock()
+	defer lock.RUnlock()
+	return hook
+}
+
+func run(q chan Event, done chan bool) {
+	defer close(done)
+	w := current()
+	ticker := time.NewTicker(time.Duration(w.FlushInterval) * time.Second)
+	defer ticker.Stop()
+	pending := []Event{}
+	for {
+		select {
+		case e, ok := <-q:
+			if !ok {
+				current().send(pending)
+				return
+			}
+			pending = append(pending, e)
+			if len(pending) >= current().BatchSize {
+				current().send(pending)
+				pending = []Event{}
+			}
+		case <-ticker.C:
+			current().send(pending)
+			pending = []Event{}
+		}
+	}
+}
+
+// Posts events, retrying with an exponential backoff on network errors, 429 and 5xx
+func (w Webhook) send(events []Event) {
+	if len(events) == 0 || w.URL == "" {
+		return
+	}
+	body, err := json.Marshal(batch{events})
+	if err != nil {
+		log.Println("events: cannot encode events:", err)
+		return
+	}
+	backoff := time.Second
+	for try := 0; ; try++ {
+		err = w.post(body)
+		if err == nil {
+			return
+		}
+		if try >= w.MaxRetries {
+			log.Println("events: dropping", len(events), "events:", err)
+			return
+		}
+		log.Println("events: retrying in", backoff, ":", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-UP-Signature", w.Sign(time.Now().Unix(), body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		log.Println("events: webhook rejected the events with status", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	received := make(chan []byte, 1)
+	signatures := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		signatures <- r.Header.Get("X-UP-Signature")
+		received <- b
+	}))
+	defer ts.Close()
+
+	w := Webhook{URL: ts.URL, Secret: "secret", BatchSize: 2}
+	if w.Defaults() {
+		t.Fatal("Defaults failed")
+	}
+	Start(w)
+	Emit(Event{Type: EndpointRefused, Endpoint: "https://example.org/up", Reason: "status 404"})
+	Emit(Event{Type: EndpointRecovered, Host: "https://example.org"})
+
+	var body []byte
+	var signature string
+	select {
+	case body = <-received:
+		signature = <-signatures
+	case <-time.After(5 * time.Second):
+		t.Fatal("No batch received")
+	}
+	Stop(time.Second)
+
+	out := batch{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("Cannot decode batch: %s", err)
+	}
+	if len(out.Events) != 2 || out.Events[0].Type != EndpointRefused || out.Events[1].Type != EndpointRecovered {
+		t.Fatalf("Unexpected batch: %s", body)
+	}
+
+	timestamp, _ := strings.CutPrefix(strings.Split(signature, ",")[0], "t=")
+	ts64, _ := strconv.ParseInt(timestamp, 10, 64)
+	if signature != w.Sign(ts64, body) {
+		t.Fatalf("Invalid signature: %s", signature)
+	}
+}
@@ -2,19 +2,35 @@ package gateway
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
+	"codeberg.org/UnifiedPush/common-proxies/ece"
+	"codeberg.org/UnifiedPush/common-proxies/registry"
 	"codeberg.org/UnifiedPush/common-proxies/utils"
 )
 
 // A Gateway that handles any URL in /aesgcm?e=ENDPOINT_ENCODED*
 // and puts the aesgcm headers in the body
+//
+// When Transcode is enabled, apps can share their receiver keys, in the
+// URL with /aesgcm?e=ENDPOINT&k=KEYS, or with a registration pushed to with
+// /aesgcm?r=ID. Messages for them are decrypted, and encrypted again as
+// standard aes128gcm messages.
 type Aesgcm struct {
-	Enabled   bool `env:"UP_GATEWAY_AESGCM_ENABLE"`
-	path      string
-	discovery []byte
+	Enabled bool `env:"UP_GATEWAY_AESGCM_ENABLE"`
+	// Reject requests whose body is not an aesgcm payload
+	StrictEncryption bool          `env:"UP_GATEWAY_AESGCM_STRICT_ENCRYPTION"`
+	Transcode        bool          `env:"UP_GATEWAY_AESGCM_TRANSCODE"`
+	Signing          SignedURLs    `envPrefix:"UP_GATEWAY_AESGCM_"`
+	Registrations    Registrations `envPrefix:"UP_GATEWAY_AESGCM_"`
+	path             string
+	discovery        []byte
+	store            registry.Store
 }
 
 func (m Aesgcm) Load() (err error) {
@@ -30,37 +46,128 @@ func (m Aesgcm) Get() []byte {
 	return m.discovery
 }
 
+func (m *Aesgcm) Routes() map[string]http.HandlerFunc {
+	routes := map[string]http.HandlerFunc{}
+	if m.store != nil {
+		reg := registrar{
+			Registrations: m.Registrations,
+			store:         m.store,
+			path:          m.path + "/register",
+			url: func(base string, id string) string {
+				query := url.Values{"r": {id}}
+				m.Signing.signQuery(query, registrationSubject+id, time.Time{})
+				return base + m.path + "?" + query.Encode()
+			},
+			authorize: m.queryEndpoint,
+			keys:      m.Transcode,
+		}
+		routes[reg.path] = reg.serve
+		routes[reg.path+"/"] = reg.serve
+	}
+	return routes
+}
+
+func (m Aesgcm) Duration() time.Duration {
+	return time.Hour
+}
+
+// Purges expired registrations
+func (m *Aesgcm) Tick() {
+	if m.store != nil {
+		purgeRegistrations(m.store)
+	}
+}
+
+// Returns the gateway URL, base and the gateway path, for endpoint, signed
+// if the gateway has signing keys
+func (m Aesgcm) GatewayURL(base string, endpoint string) (string, error) {
+	if len(m.Signing.keys) > 0 {
+		return m.Signing.Sign(base+m.path, endpoint, time.Time{})
+	}
+	return base + m.path + "?e=" + url.QueryEscape(endpoint), nil
+}
+
+// Returns the endpoint the request must be forwarded to,
+// and the receiver keys if the message must be transcoded
+func (m Aesgcm) endpoint(req http.Request) (string, *ece.Keys, error) {
+	query := req.URL.Query()
+	var endpoint, keys string
+	if id := query.Get("r"); id != "" && m.store != nil {
+		reg, err := m.store.Get(id)
+		if err != nil {
+			return "", nil, utils.NewProxyError(500, err)
+		}
+		if reg == nil {
+			return "", nil, utils.NewProxyErrS(404, "Unknown registration: %s", id)
+		}
+		if err := m.Signing.verify(registrationSubject+id, query); err != nil {
+			return "", nil, err
+		}
+		endpoint, keys = reg.Endpoint, reg.Keys
+	} else {
+		var err error
+		if endpoint, err = m.queryEndpoint(query); err != nil {
+			return "", nil, err
+		}
+		if _, err := url.Parse(endpoint); err != nil {
+			return "", nil, fmt.Errorf("Not valid endpoint: %w", err)
+		}
+		keys = query.Get("k")
+	}
+	if !m.Transcode || keys == "" {
+		return endpoint, nil, nil
+	}
+	parsed, err := ece.ParseKeys(keys)
+	if err != nil {
+		return "", nil, utils.NewProxyError(400, err)
+	}
+	return endpoint, parsed, nil
+}
+
+// Returns the endpoint e of the query, if the gateway allows it.
+// Used for pushes and registrations
+func (m Aesgcm) queryEndpoint(query url.Values) (string, error) {
+	endpoint := query.Get("e")
+	if err := m.Signing.verify(endpoint, query); err != nil {
+		return "", err
+	}
+	return endpoint, nil
+}
+
 func (m Aesgcm) Req(body []byte, req http.Request) ([]*http.Request, error) {
-	endpoint := req.URL.Query().Get("e")
-	if _, err := url.Parse(endpoint); err != nil {
-		return nil, fmt.Errorf("Not valid endpoint: %w", err)
+	endpoint, keys, err := m.endpoint(req)
+	if err != nil {
+		return nil, err
 	}
 
 	// append WebPush draft 4 (ECE Draft 3) style "aesgcm" headers to the body, so UnifiedPush apps can recieve them
 	if val := req.Header.Get("content-encoding"); val != "aesgcm" {
 		return nil, fmt.Errorf("Request is not aesgcm: %s", val)
 	}
-	cryptoKey := req.Header.Get("crypto-key")
-	encryption := req.Header.Get("encryption")
-
-	if len(cryptoKey) < 65 || len(encryption) < 16 { // heuristic, not precise
-		return nil, utils.NewProxyErrS(400, "Not real aesgcm: Headers too short")
+	headers, err := ece.ParseAesgcmHeaders(req.Header.Get("encryption"), req.Header.Get("crypto-key"))
+	if err != nil {
+		return nil, utils.NewProxyError(400, err)
+	}
+	if m.StrictEncryption {
+		if err := ece.ValidateAesgcm(headers, body); err != nil {
+			return nil, utils.NewProxyError(400, err)
+		}
+	}
+	if keys != nil {
+		return transcode(endpoint, headers, body, *keys, req.Header)
 	}
+	// the headers are normalized, so the apps only have to parse a single dh
 	newBody := []byte("aesgcm" +
-		"\nEncryption: " + encryption +
-		"\nCrypto-Key: " + cryptoKey +
+		"\nEncryption: " + headers.Encryption() +
+		"\nCrypto-Key: " + headers.CryptoKey() +
 		"\n")
 	newBody = append(newBody, body...)
 	newReq, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(newBody))
-	if val := req.Header.Get("TTL"); val != "" {
-		newReq.Header.Set("TTL", val)
-	} else {
-		newReq.Header.Set("TTL", "86400") // Cache for a day max
+	if err != nil {
+		return nil, err
 	}
-	if val := req.Header.Get("Urgency"); val != "" {
-		newReq.Header.Set("Urgency", val)
-	} else {
-		newReq.Header.Set("Urgency", "normal")
+	if err := utils.CopyWebPushHeaders(req.Header, newReq.Header); err != nil {
+		return nil, utils.NewProxyError(400, err)
 	}
 	if val := req.Header.Get("Content-Encoding"); val != "" {
 		newReq.Header.Set("Content-Encoding", val)
@@ -71,15 +178,40 @@ func (m Aesgcm) Req(body []byte, req http.Request) ([]*http.Request, error) {
 	if val := req.Header.Get("Authorization"); val != "" {
 		newReq.Header.Set("Authorization", val)
 	}
+	return []*http.Request{newReq}, nil
+}
+
+// Returns the request to forward the aesgcm message body to endpoint,
+// as a standard aes128gcm message
+func transcode(endpoint string, headers *ece.AesgcmHeaders, body []byte, keys ece.Keys, header http.Header) ([]*http.Request, error) {
+	plaintext, err := ece.DecryptAesgcm(headers, body, keys)
+	if err != nil {
+		return nil, utils.NewProxyError(400, err)
+	}
+	newBody, err := ece.EncryptWebPush(plaintext, keys.Private.PublicKey(), keys.Auth, ece.Options{})
+	if err != nil {
+		return nil, utils.NewProxyError(413, err)
+	}
+	newReq, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(newBody))
 	if err != nil {
 		return nil, err
 	}
+	if err := utils.CopyWebPushHeaders(header, newReq.Header); err != nil {
+		return nil, utils.NewProxyError(400, err)
+	}
+	newReq.Header.Set("Content-Encoding", "aes128gcm")
+	// draft VAPID: "WebPush JWT", with the key in Crypto-Key p256ecdsa
+	if jwt, ok := strings.CutPrefix(header.Get("Authorization"), "WebPush "); ok && headers.P256ECDSA != nil {
+		newReq.Header.Set("Authorization", "vapid t="+jwt+", k="+base64.RawURLEncoding.EncodeToString(headers.P256ECDSA))
+	} else if val := header.Get("Authorization"); val != "" {
+		newReq.Header.Set("Authorization", val)
+	}
 	return []*http.Request{newReq}, nil
 }
 
 func (Aesgcm) Resp(r []*http.Response, w http.ResponseWriter) {
 	if r[0] != nil {
-		w.WriteHeader(r[0].StatusCode)
+		w.WriteHeader(utils.WebPushStatus(r[0].StatusCode))
 	} else {
 		w.WriteHeader(500)
 	}
@@ -90,6 +222,10 @@ func (m *Aesgcm) Defaults() (failed bool) {
 	if m.Enabled {
 		m.path = "/aesgcm"
 		m.discovery = []byte(`{"unifiedpush":{"gateway":"aesgcm"}}`)
+		if m.Signing.Defaults("AESGCM") {
+			return true
+		}
+		m.store, failed = m.Registrations.Defaults("AESGCM")
 	}
 	return
 }
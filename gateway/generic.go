@@ -2,21 +2,53 @@ package gateway
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/UnifiedPush/common-proxies/ece"
+	"codeberg.org/UnifiedPush/common-proxies/registry"
+	"codeberg.org/UnifiedPush/common-proxies/utils"
 )
 
 // A Gateway that hanldles any URL in /generic/ENDPOINT_ENCODED/*
-// ENDPOINT_ENCODED is just a base64 encoded endpoint
+// and /generic/?e=ENDPOINT
+// ENDPOINT_ENCODED is just a base64 encoded endpoint, the trailing segments
+// are appended to the endpoint path
 // the rest of common proxies checks that the endpoint is a real UnifiedPush server before pushing to it
 // The path strategy is useful for Nextcloud
-// and aesgcm style WebPush applications
+// and aesgcm style WebPush applications, that strip or mangle query strings
 
 // NOTE: I'm using RawURLEncoded Base64 here, i.e. the URL Encoded Character set (it's going in a URL after all) and no padding (avoid unnecessary chars). That is also what WebPush most commonly uses.
+
+// When Opaque is enabled, endpoints must be exchanged for an opaque token
+// with a POST to /generic/token?e=ENDPOINT, and pushed to with /generic/?t=TOKEN.
+// Only tokens sealed with one of OpaqueKeys are forwarded. Tokens are only
+// issued to requests with an "Authorization: Bearer TOKEN_SECRET" header.
+//
+// With Registrations, endpoints can also be registered to get a short gateway
+// URL /generic/r/ID, see Registrations.
 type Generic struct {
-	Enabled bool `env:"UP_GATEWAY_GENERIC_ENABLE"`
-	path    string
+	Enabled     bool              `env:"UP_GATEWAY_GENERIC_ENABLE"`
+	Opaque      bool              `env:"UP_GATEWAY_GENERIC_OPAQUE"`
+	OpaqueKeys  map[string]string `env:"UP_GATEWAY_GENERIC_OPAQUE_KEYS"`
+	OpaqueKeyID string            `env:"UP_GATEWAY_GENERIC_OPAQUE_KEY_ID"`
+	TokenSecret string            `env:"UP_GATEWAY_GENERIC_TOKEN_SECRET"`
+	// Reject requests that are not RFC 8291 aes128gcm WebPush messages
+	StrictEncryption bool          `env:"UP_GATEWAY_GENERIC_STRICT_ENCRYPTION"`
+	Signing          SignedURLs    `envPrefix:"UP_GATEWAY_GENERIC_"`
+	Registrations    Registrations `envPrefix:"UP_GATEWAY_GENERIC_"`
+	path             string
+	opaque           *opaqueKeys
+	store            registry.Store
 }
 
 func (m Generic) Load() (err error) {
@@ -35,24 +67,251 @@ func (m Generic) Get() []byte {
 	return []byte(``)
 }
 
-func (m Generic) Req(body []byte, req http.Request) ([]*http.Request, error) {
-	endpoint := req.URL.Query().Get("e")
+func (m *Generic) Routes() map[string]http.HandlerFunc {
+	routes := map[string]http.HandlerFunc{}
+	if m.opaque != nil {
+		routes[m.path+"token"] = m.issueToken
+	}
+	if m.store != nil {
+		reg := registrar{
+			Registrations: m.Registrations,
+			store:         m.store,
+			path:          m.path + "register",
+			url: func(base string, id string) string {
+				query := url.Values{}
+				m.Signing.signQuery(query, registrationSubject+id, time.Time{})
+				if len(query) == 0 {
+					return base + m.path + "r/" + id
+				}
+				return base + m.path + "r/" + id + "?" + query.Encode()
+			},
+			authorize: m.queryEndpoint,
+		}
+		routes[reg.path] = reg.serve
+		routes[reg.path+"/"] = reg.serve
+	}
+	return routes
+}
+
+func (m Generic) Duration() time.Duration {
+	return time.Hour
+}
+
+// Purges expired registrations
+func (m *Generic) Tick() {
+	if m.store != nil {
+		purgeRegistrations(m.store)
+	}
+}
+
+// Seals the endpoint in the "e" parameter, and returns the opaque gateway URL
+func (m *Generic) issueToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	secret, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(secret), []byte(m.TokenSecret)) != 1 {
+		log.Println("Generic gateway: unauthorized token request from", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	endpoint := r.URL.Query().Get("e")
+	if err := validEndpoint(endpoint); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, err := m.opaque.seal(endpoint)
+	if err != nil {
+		log.Println("Cannot seal endpoint:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Endpoint string `json:"endpoint"`
+	}{requestBase(r) + m.path + "?t=" + token})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// Reverse proxies whose X-Forwarded-Proto header is honoured
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+// Sets the reverse proxies, IP addresses or CIDR ranges, whose
+// X-Forwarded-Proto header is honoured
+func SetTrustedProxies(proxies []string) error {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return fmt.Errorf("Not valid trusted proxy %q: %w", proxy, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	trustedProxies.Store(&prefixes)
+	return nil
+}
+
+// Returns true if the request comes from a trusted reverse proxy
+func fromTrustedProxy(r *http.Request) bool {
+	prefixes := trustedProxies.Load()
+	if prefixes == nil {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range *prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the gateway URL, base and the gateway path, for endpoint, as the
+// gateway accepts it: an endpoint token with opaque keys, else signed with
+// signing keys
+func (m Generic) GatewayURL(base string, endpoint string) (string, error) {
+	if m.opaque != nil {
+		token, err := m.opaque.seal(endpoint)
+		if err != nil {
+			return "", err
+		}
+		return base + m.path + "?t=" + token, nil
+	}
+	if len(m.Signing.keys) > 0 {
+		return m.Signing.Sign(base+m.path, endpoint, time.Time{})
+	}
+	return base + m.path + "?e=" + url.QueryEscape(endpoint), nil
+}
+
+// Returns scheme://host of the request, as seen by the client.
+// X-Forwarded-Proto is only honoured from trusted proxies
+func requestBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); (proto == "https" || proto == "http") && fromTrustedProxy(r) {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// Returns the endpoint the request must be forwarded to
+func (m Generic) endpoint(req http.Request) (string, error) {
+	query := req.URL.Query()
+	if id, ok := strings.CutPrefix(req.URL.Path, m.path+"r/"); ok && m.store != nil {
+		reg, err := m.store.Get(id)
+		if err != nil {
+			return "", utils.NewProxyError(500, err)
+		}
+		if reg == nil {
+			return "", utils.NewProxyErrS(404, "Unknown registration: %s", id)
+		}
+		if err := m.Signing.verify(registrationSubject+id, query); err != nil {
+			return "", err
+		}
+		return reg.Endpoint, nil
+	}
+	if encoded, ok := strings.CutPrefix(req.URL.Path, m.path); ok && encoded != "" {
+		if m.Opaque {
+			return "", utils.NewProxyErrS(403, "Raw endpoints are disabled, an endpoint token is required")
+		}
+		endpoint, err := decodePathEndpoint(encoded)
+		if err != nil {
+			return "", utils.NewProxyError(400, err)
+		}
+		if err := m.Signing.verify(endpoint, query); err != nil {
+			return "", err
+		}
+		return endpoint, nil
+	}
+	endpoint, err := m.queryEndpoint(query)
+	if err != nil {
+		return "", err
+	}
 	if _, err := url.Parse(endpoint); err != nil {
-		return nil, fmt.Errorf("Not valid endpoint: %w", err)
+		return "", fmt.Errorf("Not valid endpoint: %w", err)
+	}
+	return endpoint, nil
+}
+
+// Returns the endpoint of the query, a token t or an endpoint e,
+// if the gateway allows it. Used for pushes and registrations
+func (m Generic) queryEndpoint(query url.Values) (string, error) {
+	if token := query.Get("t"); token != "" && m.opaque != nil {
+		endpoint, err := m.opaque.open(token)
+		if err != nil {
+			return "", utils.NewProxyError(404, err)
+		}
+		return endpoint, nil
+	}
+	if m.Opaque {
+		return "", utils.NewProxyErrS(403, "Raw endpoints are disabled, an endpoint token is required")
+	}
+	endpoint := query.Get("e")
+	if err := m.Signing.verify(endpoint, query); err != nil {
+		return "", err
+	}
+	return endpoint, nil
+}
+
+// Decodes ENDPOINT_ENCODED/TRAILING/SEGMENTS to the endpoint,
+// with the trailing segments appended to its path
+func decodePathEndpoint(encoded string) (string, error) {
+	encoded, trailing, _ := strings.Cut(encoded, "/")
+	raw, err := base64.RawURLEncoding.Strict().DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("Endpoint is not RawURL base64 encoded: %w", err)
+	}
+	endpoint := string(raw)
+	if err := validEndpoint(endpoint); err != nil {
+		return "", err
+	}
+	if trailing == "" {
+		return endpoint, nil
+	}
+	u, _ := url.Parse(endpoint)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + trailing
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func (m Generic) Req(body []byte, req http.Request) ([]*http.Request, error) {
+	endpoint, err := m.endpoint(req)
+	if err != nil {
+		return nil, err
+	}
+	if m.StrictEncryption {
+		if val := req.Header.Get("Content-Encoding"); val != "" && val != "aes128gcm" {
+			return nil, utils.NewProxyErrS(400, "Request is not aes128gcm: %s", val)
+		}
+		if err := ece.ValidateWebPush(body); err != nil {
+			return nil, utils.NewProxyError(400, err)
+		}
 	}
 	newReq, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
-	newReq.Header.Set("TTL", "86400") // Cache for a day max
-	newReq.Header.Set("Urgency", "normal")
+	if err := utils.CopyWebPushHeaders(req.Header, newReq.Header); err != nil {
+		return nil, utils.NewProxyError(400, err)
+	}
 	newReq.Header.Set("Content-Encoding", "aes128gcm")
 	return []*http.Request{newReq}, nil
 }
 
 func (Generic) Resp(r []*http.Response, w http.ResponseWriter) {
 	if r[0] != nil {
-		w.WriteHeader(r[0].StatusCode)
+		w.WriteHeader(utils.WebPushStatus(r[0].StatusCode))
 	} else {
 		w.WriteHeader(500)
 	}
@@ -61,5 +320,27 @@ func (Generic) Resp(r []*http.Response, w http.ResponseWriter) {
 
 func (m *Generic) Defaults() (failed bool) {
 	m.path = "/generic/"
+	m.opaque = nil
+	if m.Signing.Defaults("Generic") {
+		return true
+	}
+	if m.store, failed = m.Registrations.Defaults("Generic"); failed {
+		return
+	}
+	if len(m.OpaqueKeys) > 0 {
+		opaque, err := newOpaqueKeys(m.OpaqueKeys, m.OpaqueKeyID)
+		if err != nil {
+			log.Println("Generic gateway opaque keys:", err)
+			return true
+		}
+		m.opaque = opaque
+		if len(m.TokenSecret) < 16 {
+			log.Println("Generic gateway token secret must be at least 16 characters long when opaque keys are set")
+			failed = true
+		}
+	} else if m.Opaque {
+		log.Println("Generic gateway opaque keys cannot be empty when opaque endpoints are enabled")
+		failed = true
+	}
 	return
 }
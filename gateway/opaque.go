@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Opaque endpoint tokens: the target endpoint sealed with AES-256-GCM.
+// A token is base64url(len(keyid) || keyid || nonce || ciphertext), the key id
+// is authenticated as additional data. Older keys are kept to open tokens
+// issued before a rotation, only the current key seals new tokens.
+type opaqueKeys struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// keys maps a key id to a base64 encoded 32 bytes key
+func newOpaqueKeys(keys map[string]string, current string) (*opaqueKeys, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key id %q is not in the keys", current)
+	}
+	o := &opaqueKeys{current: current, aeads: map[string]cipher.AEAD{}}
+	for id, k := range keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("key id %q must be between 1 and 255 bytes", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			raw, err = base64.RawURLEncoding.DecodeString(k)
+		}
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, base64 encoded", id)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		o.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *opaqueKeys) seal(endpoint string) (string, error) {
+	aead := o.aeads[o.current]
+	header := append([]byte{byte(len(o.current))}, o.current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := append(header, nonce...)
+	out = aead.Seal(out, nonce, []byte(endpoint), header)
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+var errInvalidToken = errors.New("Invalid endpoint token")
+
+func (o *opaqueKeys) open(token string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < 1 || len(raw) < 1+int(raw[0]) {
+		return "", errInvalidToken
+	}
+	header := raw[:1+int(raw[0])]
+	aead, ok := o.aeads[string(header[1:])]
+	if !ok || len(raw) < len(header)+aead.NonceSize() {
+		return "", errInvalidToken
+	}
+	nonce := raw[len(header) : len(header)+aead.NonceSize()]
+	endpoint, err := aead.Open(nil, nonce, raw[len(header)+aead.NonceSize():], header)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	return string(endpoint), nil
+}
+
+// Checks endpoint is an absolute http(s) URL
+func validEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("Not valid endpoint: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("Not valid endpoint: %s", endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package gateway
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"codeberg.org/UnifiedPush/common-proxies/ece"
+	"codeberg.org/UnifiedPush/common-proxies/registry"
+	"codeberg.org/UnifiedPush/common-proxies/utils"
+)
+
+// Endpoint registrations, on a gateway with the path /PATH/:
+//
+//	POST   /PATH/register?e=ENDPOINT  returns a short gateway URL, and a secret
+//	PUT    /PATH/register/ID          refreshes the expiry, ?e=ENDPOINT changes the endpoint
+//	DELETE /PATH/register/ID          unregisters
+//
+// PUT and DELETE need an "Authorization: Bearer SECRET" header.
+// Gateways that transcode messages also accept the receiver keys, ?k=KEYS.
+// Endpoints are accepted under the same conditions as for pushes: with a
+// signature when signed URLs are required, or as a token in opaque mode.
+type Registrations struct {
+	Enabled bool   `env:"REGISTRATION_ENABLE"`
+	Store   string `env:"REGISTRATION_STORE"` // memory, file or sqlite
+	Path    string `env:"REGISTRATION_PATH"`
+	TTL     int    `env:"REGISTRATION_TTL"` // seconds
+	// Registrations kept at most, new ones are refused beyond
+	Max int `env:"REGISTRATION_MAX"`
+}
+
+func (r *Registrations) Defaults(gateway string) (store registry.Store, failed bool) {
+	if !r.Enabled {
+		return
+	}
+	if r.Store == "" {
+		r.Store = "memory"
+	}
+	if r.TTL <= 0 {
+		r.TTL = 90 * 24 * 60 * 60 // 90 days
+	}
+	if r.Max <= 0 {
+		r.Max = 100000
+	}
+	store, err := registry.Open(gateway, r.Store, r.Path)
+	if err != nil {
+		log.Println(gateway, "gateway registrations:", err)
+		return nil, true
+	}
+	return
+}
+
+func (r Registrations) ttl() time.Duration {
+	return time.Duration(r.TTL) * time.Second
+}
+
+type registrationResp struct {
+	ID       string    `json:"id"`
+	Endpoint string    `json:"endpoint"`
+	Secret   string    `json:"secret,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+func writeRegistration(w http.ResponseWriter, code int, resp registrationResp) {
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// Purges the expired registrations of store
+func purgeRegistrations(store registry.Store) {
+	n, err := store.Purge(time.Now())
+	if err != nil {
+		log.Println("Cannot purge registrations:", err)
+	} else if n > 0 {
+		log.Println("Purged", n, "expired registrations")
+	}
+}
+
+// Serves the register routes of a gateway
+type registrar struct {
+	Registrations
+	store registry.Store
+	// the register route, PATH/register
+	path string
+	// returns the gateway URL of the registration id
+	url func(base string, id string) string
+	// returns the endpoint of the query, if the gateway allows it
+	authorize func(query url.Values) (string, error)
+	// receiver keys can be registered with ?k=KEYS
+	keys bool
+}
+
+// Returns the endpoint of the request, if the gateway allows it
+func (g registrar) requestEndpoint(r *http.Request) (string, int) {
+	endpoint, err := g.authorize(r.URL.Query())
+	if err != nil {
+		if perr, ok := err.(*utils.ProxyError); ok {
+			return "", perr.Code
+		}
+		return "", http.StatusBadRequest
+	}
+	if err := validEndpoint(endpoint); err != nil {
+		return "", http.StatusBadRequest
+	}
+	return endpoint, 0
+}
+
+// Returns the receiver keys of the request, if any, normalized
+func (g registrar) requestKeys(r *http.Request) (keys string, ok bool) {
+	k := r.URL.Query().Get("k")
+	if k == "" || !g.keys {
+		return "", true
+	}
+	parsed, err := ece.ParseKeys(k)
+	if err != nil {
+		return "", false
+	}
+	return parsed.String(), true
+}
+
+func (g registrar) serve(w http.ResponseWriter, r *http.Request) {
+	id, hasID := strings.CutPrefix(r.URL.Path, g.path+"/")
+	switch {
+	case r.Method == http.MethodPost && !hasID:
+		endpoint, code := g.requestEndpoint(r)
+		if code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		keys, ok := g.requestKeys(r)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if n, err := g.store.Count(); err != nil {
+			log.Println("Cannot count registrations:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if n >= g.Max {
+			log.Println("Registration refused, the store is full:", n, "registrations")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reg, secret, err := registry.New(endpoint, g.ttl())
+		reg.Keys = keys
+		if err == nil {
+			err = g.store.Put(reg)
+		}
+		if err != nil {
+			log.Println("Cannot register endpoint:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeRegistration(w, http.StatusCreated, registrationResp{
+			ID:       reg.ID,
+			Endpoint: g.url(requestBase(r), reg.ID),
+			Secret:   secret,
+			Expires:  reg.Expires,
+		})
+	case (r.Method == http.MethodPut || r.Method == http.MethodDelete) && hasID && id != "":
+		reg, err := g.store.Get(id)
+		if err != nil {
+			log.Println("Cannot get registration:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		secret, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if reg == nil || !reg.CheckSecret(secret) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if err := g.store.Delete(id); err != nil {
+				log.Println("Cannot delete registration:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if query := r.URL.Query(); query.Get("e") != "" || query.Get("t") != "" {
+			endpoint, code := g.requestEndpoint(r)
+			if code != 0 {
+				w.WriteHeader(code)
+				return
+			}
+			reg.Endpoint = endpoint
+		}
+		if keys, ok := g.requestKeys(r); !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if keys != "" {
+			reg.Keys = keys
+		}
+		reg.Expires = time.Now().Add(g.ttl())
+		if err := g.store.Put(*reg); err != nil {
+			log.Println("Cannot refresh registration:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeRegistration(w, http.StatusOK, registrationResp{
+			ID:       reg.ID,
+			Endpoint: g.url(requestBase(r), reg.ID),
+			Expires:  reg.Expires,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"codeberg.org/UnifiedPush/common-proxies/utils"
+)
+
+// Signed gateway URLs: ?e=ENDPOINT&kid=KEY_ID&exp=UNIX_TIME&sig=SIGNATURE
+// where SIGNATURE is the base64url HMAC-SHA256, keyed with the key KEY_ID,
+// of "KEY_ID\nUNIX_TIME\nENDPOINT". An exp of 0 never expires.
+// When Required, unsigned endpoints are rejected.
+type SignedURLs struct {
+	Required bool              `env:"SIGNED_REQUIRED"`
+	Keys     map[string]string `env:"SIGNING_KEYS"`
+	KeyID    string            `env:"SIGNING_KEY_ID"`
+	keys     map[string][]byte
+}
+
+func signature(key []byte, kid string, exp int64, endpoint string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d\n%s", kid, exp, endpoint)
+	return mac.Sum(nil)
+}
+
+// Returns the gateway URL base signed for endpoint, with the current key.
+// exp is ignored if zero
+func (s SignedURLs) Sign(base string, endpoint string, exp time.Time) (string, error) {
+	if _, ok := s.keys[s.KeyID]; !ok {
+		return "", errors.New("No signing key configured")
+	}
+	if err := validEndpoint(endpoint); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("e", endpoint)
+	s.signQuery(query, endpoint, exp)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Adds the signature of subject, with the current key, to query.
+// Does nothing if there is no signing key
+func (s SignedURLs) signQuery(query url.Values, subject string, exp time.Time) {
+	key, ok := s.keys[s.KeyID]
+	if !ok {
+		return
+	}
+	var unix int64
+	if !exp.IsZero() {
+		unix = exp.Unix()
+	}
+	query.Set("kid", s.KeyID)
+	query.Set("exp", strconv.FormatInt(unix, 10))
+	query.Set("sig", base64.RawURLEncoding.EncodeToString(signature(key, s.KeyID, unix, subject)))
+}
+
+// Signatures of registration URLs are over this prefix and the id,
+// so they can't be mistaken for signatures of endpoints
+const registrationSubject = "registration:"
+
+// Checks the signature of endpoint in query, if there is one
+// or if signatures are required
+func (s SignedURLs) verify(endpoint string, query url.Values) error {
+	if !query.Has("sig") {
+		if s.Required {
+			return utils.NewProxyErrS(403, "Gateway URL must be signed")
+		}
+		return nil
+	}
+	key, ok := s.keys[query.Get("kid")]
+	if !ok {
+		return utils.NewProxyErrS(403, "Unknown signing key: %s", query.Get("kid"))
+	}
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return utils.NewProxyErrS(403, "Invalid signature expiry")
+	}
+	if exp != 0 && time.Now().Unix() > exp {
+		return utils.NewProxyErrS(403, "Gateway URL signature has expired")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	if err != nil || !hmac.Equal(sig, signature(key, query.Get("kid"), exp, endpoint)) {
+		return utils.NewProxyErrS(403, "Invalid gateway URL signature")
+	}
+	return nil
+}
+
+func (s *SignedURLs) Defaults(gateway string) (failed bool) {
+	s.keys = map[string][]byte{}
+	for id, k := range s.Keys {
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			raw, err = base64.RawURLEncoding.DecodeString(k)
+		}
+		if err != nil || len(raw) < 32 {
+			log.Println(gateway, "gateway signing key", id, "must be at least 32 bytes, base64 encoded")
+			failed = true
+		}
+		s.keys[id] = raw
+	}
+	if s.Required && len(s.keys) == 0 {
+		log.Println(gateway, "gateway signing keys cannot be empty when signed URLs are required")
+		failed = true
+	}
+	if len(s.keys) > 0 {
+		if _, ok := s.keys[s.KeyID]; !ok {
+			log.Println(gateway, "gateway signing key id", s.KeyID, "is not in the signing keys")
+			failed = true
+		}
+	}
+	return
+}
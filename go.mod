@@ -8,9 +8,9 @@ require (
 	github.com/caarlos0/env/v6 v6.10.1
 	github.com/hakobe/paranoidhttp v0.3.0
 	github.com/komkom/toml v0.1.2
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/stretchr/testify v1.9.0
 	golang.org/x/oauth2 v0.25.0
+	modernc.org/sqlite v1.21.2
 )
 
 require (
@@ -335,7 +335,6 @@ require (
 	modernc.org/mathutil v1.5.0 // indirect
 	modernc.org/memory v1.5.0 // indirect
 	modernc.org/opt v0.1.3 // indirect
-	modernc.org/sqlite v1.21.2 // indirect
 	modernc.org/strutil v1.1.3 // indirect
 	modernc.org/tcl v1.15.1 // indirect
 	modernc.org/token v1.1.0 // indirect
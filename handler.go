@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -73,23 +75,25 @@ func gatewayHandler(h Gateway) HttpHandler {
 				nwritten += req.ContentLength
 				url := req.URL
 
-				req.Header.Add("User-Agent", Config.GetUserAgent())
-				req.Header.Add("TTL", "86400")                  // Cache for a day max
-				req.Header.Add("Content-encoding", "aes128gcm") // Fake encryption
+				req.Header.Set("User-Agent", Config.GetUserAgent())
+				utils.DefaultWebPushHeaders(req.Header, Config.Gateway.MaxTTL)
+				if req.Header.Get("Content-Encoding") == "" {
+					req.Header.Set("Content-Encoding", "aes128gcm") // Fake encryption
+				}
 
 				thisClient := paranoidClient
 				if utils.InStringSlice(config.Config.Gateway.AllowedHosts, req.URL.Host) {
 					thisClient = normalClient
 				}
-				cacheStatus := getEndpointStatus(url)
+				cacheStatus := allowEndpoint(url)
 				if cacheStatus == Refused {
-					log.Println("handler: req to", req.Host, ", URL is cached as refused")
+					log.Println("handler: req to", req.Host, ", URL breaker is open (refused)")
 					resps[i] = &http.Response{
-						StatusCode: 404,
+						StatusCode: 410,
 						Request:    req,
 					}
 				} else if cacheStatus == TemporaryUnavailable {
-					log.Println("handler: req to", req.Host, ", URL is cached as temp unavailable")
+					log.Println("handler: req to", req.Host, ", URL breaker is open (temp unavailable)")
 					resps[i] = &http.Response{
 						StatusCode: 429,
 						Request:    req,
@@ -97,66 +101,37 @@ func gatewayHandler(h Gateway) HttpHandler {
 				} else {
 					resps[i], err = thisClient.Do(req)
 					if err != nil {
-						var netErr net.Error
-						var dnsErr *net.DNSError
-						switch {
-						case errors.As(err, &dnsErr):
-							// This is a workaround to make the tests work with woodpecker
-							if dnsErr.IsNotFound || req.URL.Host == "doesnotexist.unifiedpush.org" {
-								log.Println("handler: req to", req.Host, ", caching URL as refused (Domain not found)")
-								resps[i] = &http.Response{
-									StatusCode: 404,
-									Request:    req,
-								}
-								setHostStatus(url, Refused)
-							} else {
-								log.Println("handler: req to", req.Host, ", caching URL as temp unavailable. DNSError:", dnsErr)
-								resps[i] = &http.Response{
-									StatusCode: 429,
-									Request:    req,
-								}
-								setHostStatus(url, TemporaryUnavailable)
-							}
-						case errors.As(err, &netErr) && netErr.Timeout():
-							log.Println("handler: req to", req.Host, ", caching URL as temp unavailable (Timeout error)")
-							resps[i] = &http.Response{
-								StatusCode: 429,
-								Request:    req,
-							}
-							setHostStatus(url, TemporaryUnavailable)
-						default:
-							// This can be:
-							// - unsupported protocol
-							// - bad ip
-							// - invalid tls certif
-							log.Println("handler: req to", req.Host, ", caching URL as refused. Err:", err)
-							resps[i] = &http.Response{
-								StatusCode: 404,
-								Request:    req,
-							}
-							setHostStatus(url, Refused)
+						resps[i] = &http.Response{Request: req}
+						status, reason := hostErrorStatus(req, err)
+						if status == Refused {
+							resps[i].StatusCode = 410
+						} else {
+							resps[i].StatusCode = 429
 						}
+						hostFailure(url, status, reason)
+						endpointAbort(url)
 					} else {
+						// The push server answered, its host is reachable
+						hostSuccess(url)
 						sc := resps[i].StatusCode
-						switch {
-						case sc == 404:
-							log.Println("handler: req to", req.Host, ", caching URL as refused (Status= 404)")
-							setEndpointStatus(url, Refused)
-						case sc == 429:
-							log.Println("handler: req to", req.Host, ", caching URL as temp unavailable (Status= 429)")
-							setEndpointStatus(url, TemporaryUnavailable)
+						switch outcome := utils.ClassifyStatus(sc); {
+						case outcome == utils.Delivered:
+							endpointSuccess(url)
+						case outcome == utils.Gone:
+							log.Println("handler: req to", req.Host, ", endpoint failure: gone (Status=", sc, ")")
+							resps[i].StatusCode = 410
+							endpointFailure(url, Refused, "status "+strconv.Itoa(sc))
+						case outcome == utils.Transient:
+							log.Println("handler: req to", req.Host, ", endpoint failure: temp unavailable (Status=", sc, ")")
+							endpointFailure(url, TemporaryUnavailable, "status "+strconv.Itoa(sc))
 						case sc == 413:
 							log.Println("handler: req to", req.Host, ", Request was too long (Status= 413)")
-						// ntfy does not return 201
-						case sc == 201 || sc == 200:
-							// DO nothing
-						case sc > 499:
-							log.Println("handler: req to", req.Host, ", caching URL as temp unavailable (Status=", sc, ")")
-							setEndpointStatus(url, TemporaryUnavailable)
+							endpointSuccess(url)
 						default:
-							log.Println("handler: req to", req.Host, ", caching URL as refused. Unexpected status code. (Status=", sc, ")")
-							resps[i].StatusCode = 404
-							setEndpointStatus(url, Refused)
+							// The push server rejected this request, not the endpoint:
+							// the status is given to the sender
+							log.Println("handler: req to", req.Host, ", request rejected (Status=", sc, ")")
+							endpointSuccess(url)
 						}
 					}
 				}
@@ -186,12 +161,40 @@ func gatewayHandler(h Gateway) HttpHandler {
 
 }
 
+// Classifies an error of a request to a push server,
+// these errors are counted against the host breaker
+func hostErrorStatus(req *http.Request, err error) (EndpointStatus, string) {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		// This is a workaround to make the tests work with woodpecker
+		if dnsErr.IsNotFound || req.URL.Host == "doesnotexist.unifiedpush.org" {
+			log.Println("handler: req to", req.Host, ", host failure: refused (Domain not found)")
+			return Refused, "domain not found"
+		}
+		log.Println("handler: req to", req.Host, ", host failure: temp unavailable. DNSError:", dnsErr)
+		return TemporaryUnavailable, dnsErr.Error()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		log.Println("handler: req to", req.Host, ", host failure: temp unavailable (Timeout error)")
+		return TemporaryUnavailable, "timeout"
+	default:
+		// This can be:
+		// - unsupported protocol
+		// - bad ip
+		// - invalid tls certif
+		log.Println("handler: req to", req.Host, ", host failure: refused. Err:", err)
+		return Refused, err.Error()
+	}
+}
+
 func proxyHandler(h Proxy) HttpHandler {
 
 	versionWrite := versionHandler()
+	retries := newRetrier()
 	return func(w http.ResponseWriter, r *http.Request) {
 		var nread, code int = 0, 200
-		var respType string
+		var respType, report, retryAfter string
 
 		switch r.Method {
 
@@ -215,41 +218,65 @@ func proxyHandler(h Proxy) HttpHandler {
 				break
 			}
 
-			var resp *http.Response
-			for _, req := range reqs {
-				resp, err = normalClient.Do(req)
-				if errHandle(err, w) {
-					respType = "err"
-					break
-				}
-
-				resperr := h.RespCode(resp)
-				code = utils.Max(code, resperr.Code)
-				if errHandle(err, w) {
-					respType = "err"
-					break
+			code, retryAfter, err = sendParts(r.Context(), h, reqs, retries)
+			if err != nil {
+				logV(err)
+				respType = "err"
+				if len(reqs) > 1 {
+					// The message is lost, the sender should send it again
+					respType = "partial"
+					report = err.Error()
 				}
-				// logic here is that bigger code is worse and should be returned. If one request was ok (200) but one failed (400-500s), the larger one should be returned. It's not perfect, but 🤷
-
-				//read upto 4000 to be able to reuse conn then close
-				// this 4000 is arbritary and not related to the size limit
-				io.ReadAll(io.LimitReader(r.Body, 4000))
-				resp.Body.Close()
+				break
 			}
-
 			respType = "forward"
 
 		default:
 			code = http.StatusMethodNotAllowed
 			respType = "method not allowed"
 		}
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
 		w.WriteHeader(code)
-		log.Println(r.Method, r.Host, r.URL.Path, r.RemoteAddr, nread, "bytes read;", r.UserAgent(), respType, code)
+		if report != "" {
+			fmt.Fprintln(w, report)
+		}
+		log.Println(r.Method, r.Host, r.URL.Path, r.RemoteAddr, nread, "bytes read;", r.UserAgent(), respType, code, report)
 
 		return
 	}
 }
 
+// Sends the requests of a message in order, and returns the status of the
+// last one. A message split in several requests can't be used by the
+// receiver if a part is missing, so it stops at the first failure. For
+// these messages, the error tells which part failed
+func sendParts(ctx context.Context, h Proxy, reqs []*http.Request, retries *retrier) (code int, retryAfter string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, Config.Retry.TimeoutDuration())
+	defer cancel()
+	for i, req := range reqs {
+		resp, err := retries.do(ctx, normalClient, req)
+		if err != nil {
+			if len(reqs) > 1 {
+				err = fmt.Errorf("part %d/%d failed, %d sent: %w", i+1, len(reqs), i, err)
+			}
+			return http.StatusBadGateway, "", err
+		}
+		resperr := h.RespCode(resp)
+		//read upto 4000 to be able to reuse conn then close
+		// this 4000 is arbritary and not related to the size limit
+		io.ReadAll(io.LimitReader(resp.Body, 4000))
+		resp.Body.Close()
+		if len(reqs) > 1 && resperr.Code >= 300 {
+			return resperr.Code, resperr.RetryAfter, fmt.Errorf("part %d/%d failed, %d sent: %d %s", i+1, len(reqs), i, resperr.Code, resperr.S)
+		}
+		code = resperr.Code
+		retryAfter = resperr.RetryAfter
+	}
+	return code, retryAfter, nil
+}
+
 func errHandle(e error, w http.ResponseWriter) bool {
 	if e != nil {
 		if err, ok := e.(*utils.ProxyError); ok && (err.S.Error() != "") {
@@ -9,11 +9,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"codeberg.org/UnifiedPush/common-proxies/config"
 	. "codeberg.org/UnifiedPush/common-proxies/config"
+	"codeberg.org/UnifiedPush/common-proxies/events"
 	"codeberg.org/UnifiedPush/common-proxies/vapid"
 )
 
@@ -37,6 +39,10 @@ func genVapid() {
 }
 
 func main() {
+	if runCommand() {
+		return
+	}
+	flag.Usage = commandsUsage
 	flag.Parse()
 
 	if *genVapidFlag {
@@ -69,22 +75,43 @@ func main() {
 			if config.Config.Verbose {
 				fmt.Println("Handling", i.Path())
 			}
+			if r, ok := i.(RoutedGateway); ok {
+				for path, f := range r.Routes() {
+					myRouter.HandleFunc(path, bothHandler(HttpHandler(f)))
+					if config.Config.Verbose {
+						fmt.Println("Handling", path)
+					}
+				}
+			}
 		}
 		handleTicker(i, stopTickers)
 	}
 
-	myRouter.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(config.Config.GetUserAgent() + " OK"))
-	})
+	myRouter.HandleFunc("/health", healthHandler)
 	myRouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Endpoint doesn't exist\n"))
 	})
 
 	server := &http.Server{
-		Addr:    Config.ListenAddr,
-		Handler: myRouter,
+		Addr:              Config.ListenAddr,
+		Handler:           myRouter,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+	}
+
+	var adminServer *http.Server
+	if Config.Admin.ListenAddr != "" {
+		adminServer = &http.Server{
+			Addr:    Config.Admin.ListenAddr,
+			Handler: adminRouter(),
+		}
+		go func() {
+			log.Println("Admin API is listening at", Config.Admin.ListenAddr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Could not listen on %s: %v\n", Config.Admin.ListenAddr, err)
+			}
+		}()
 	}
 
 	done := make(chan bool)
@@ -106,6 +133,10 @@ func main() {
 				defer cancel()
 
 				stopTickers <- true
+				if adminServer != nil {
+					adminServer.Shutdown(ctx)
+				}
+				events.Stop(10 * time.Second)
 				server.SetKeepAlivesEnabled(false)
 				if err := server.Shutdown(ctx); err != nil {
 					log.Fatalf("Could not gracefully shutdown the server: %v\n", err)
@@ -128,6 +159,25 @@ func main() {
 
 }
 
+// Returns 503 with the errors of the enabled handlers, if any
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []string
+	for _, h := range handlers {
+		if c, ok := h.(HealthChecker); ok && h.Path() != "" {
+			if err := c.Health(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(config.Config.GetUserAgent() + " UNHEALTHY\n" + strings.Join(errs, "\n")))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(config.Config.GetUserAgent() + " OK"))
+}
+
 func handle(handler Handler) HttpHandler {
 	if h, ok := handler.(Gateway); ok {
 		return bothHandler(gatewayHandler(h))
@@ -2,18 +2,33 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"codeberg.org/UnifiedPush/common-proxies/config"
+	"codeberg.org/UnifiedPush/common-proxies/ece"
 	"codeberg.org/UnifiedPush/common-proxies/gateway"
 	"codeberg.org/UnifiedPush/common-proxies/rewrite"
+	"codeberg.org/UnifiedPush/common-proxies/utils"
+	"codeberg.org/UnifiedPush/common-proxies/vapid"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/oauth2"
 )
@@ -116,7 +131,7 @@ func (s *RewriteTests) TestMatrixAllowed() {
 
 func (s *RewriteTests) TestMatrixRejectedFromCache() {
 	u, _ := neturl.Parse(s.ts.URL)
-	setEndpointStatus(u, Refused)
+	refuseEndpoint(u)
 	matrix := gateway.Matrix{}
 
 	url := s.ts.URL
@@ -137,8 +152,12 @@ func (s *RewriteTests) TestMatrixRejected404() {
 
 	url := s.ts.URL
 	content := `{"notification":{"devices":[{"pushkey":"` + url + `"}], "counts":{"unread":1}}}`
-	request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
-	handle(&matrix)(s.Resp, request)
+	// The breaker opens after FailureThreshold failures
+	for i := 0; i < config.Config.Cache.FailureThreshold; i++ {
+		s.resetTest()
+		request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
+		handle(&matrix)(s.Resp, request)
+	}
 
 	//resp
 	s.Equal(200, s.Resp.Result().StatusCode, "request should be valid")
@@ -148,6 +167,352 @@ func (s *RewriteTests) TestMatrixRejected404() {
 	s.Equal(Refused, getEndpointStatus(u))
 }
 
+func (s *RewriteTests) TestMatrixRejected410() {
+	// Setup allowed web push endpoint unsubscribed
+	s.SetupTestServer(410, true, false)
+	matrix := gateway.Matrix{}
+
+	url := s.ts.URL
+	content := `{"notification":{"devices":[{"pushkey":"` + url + `"}], "counts":{"unread":1}}}`
+	request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
+	handle(&matrix)(s.Resp, request)
+
+	//resp
+	s.Equal(200, s.Resp.Result().StatusCode, "request should be valid")
+	body, _ := io.ReadAll(s.Resp.Body)
+	s.Equal(`{"rejected":["`+url+`"]}`, string(body))
+}
+
+func (s *RewriteTests) TestGenericGone() {
+	// Setup allowed web push endpoint unsubscribed
+	s.SetupTestServer(404, true, false)
+	gw := gateway.Generic{}
+	gw.Defaults()
+
+	request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+
+	s.Equal(410, s.Resp.Result().StatusCode, "unsubscription should be reported as gone")
+}
+
+func (s *RewriteTests) TestGenericRejected() {
+	s.ts.Close()
+	for _, code := range []int{401, 403} {
+		s.SetupTestServer(code, true, false)
+		gw := gateway.Generic{}
+		gw.Defaults()
+
+		for i := 0; i < config.Config.Cache.FailureThreshold; i++ {
+			s.resetTest()
+			request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+			handle(&gw)(s.Resp, request)
+			s.Equal(code, s.Resp.Result().StatusCode, "rejections should be given to the sender")
+		}
+		u, _ := neturl.Parse(s.ts.URL)
+		s.Equal(NotCached, getEndpointStatus(u), "rejections should not open the breaker")
+		s.ts.Close()
+	}
+}
+
+func (s *RewriteTests) TestGenericOpaque() {
+	gw := gateway.Generic{
+		Enabled:     true,
+		Opaque:      true,
+		OpaqueKeys:  map[string]string{"old": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "new": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="},
+		OpaqueKeyID: "new",
+	}
+	s.True(gw.Defaults(), "a token secret should be required")
+	gw.TokenSecret = "0123456789abcdef"
+	s.Require().False(gw.Defaults())
+
+	request := httptest.NewRequest("POST", "/generic/token?e="+neturl.QueryEscape(s.ts.URL), nil)
+	gw.Routes()["/generic/token"](s.Resp, request)
+	s.Equal(401, s.Resp.Result().StatusCode, "unauthenticated token requests should be rejected")
+
+	s.resetTest()
+	request.Header.Set("Authorization", "Bearer wrong")
+	gw.Routes()["/generic/token"](s.Resp, request)
+	s.Equal(401, s.Resp.Result().StatusCode, "token requests with a wrong secret should be rejected")
+
+	s.resetTest()
+	request.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	gw.Routes()["/generic/token"](s.Resp, request)
+	s.Equal(200, s.Resp.Result().StatusCode)
+	out := struct{ Endpoint string }{}
+	s.Require().Nil(json.NewDecoder(s.Resp.Body).Decode(&out))
+	s.NotContains(out.Endpoint, neturl.QueryEscape(s.ts.URL), "endpoint should be opaque")
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", out.Endpoint, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal("msg", string(s.CallBody))
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "raw endpoints should be rejected")
+	s.Nil(s.Call)
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/?t=AAAA", bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(404, s.Resp.Result().StatusCode, "unknown tokens should be rejected")
+	s.Nil(s.Call)
+}
+
+func (s *RewriteTests) TestGenericSigned() {
+	gw := gateway.Generic{Enabled: true}
+	gw.Signing.Required = true
+	gw.Signing.Keys = map[string]string{"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+	gw.Signing.KeyID = "k1"
+	s.Require().False(gw.Defaults())
+
+	signed, err := gw.Signing.Sign("http://localhost/generic/", s.ts.URL, time.Now().Add(time.Hour))
+	s.Require().Nil(err)
+	request := httptest.NewRequest("POST", signed, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "unsigned endpoints should be rejected")
+	s.Nil(s.Call)
+
+	s.resetTest()
+	tampered, _ := neturl.Parse(signed)
+	query := tampered.Query()
+	query.Set("e", s.ts.URL+"/other")
+	tampered.RawQuery = query.Encode()
+	request = httptest.NewRequest("POST", tampered.String(), bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "tampered endpoints should be rejected")
+	s.Nil(s.Call)
+
+	s.resetTest()
+	expired, err := gw.Signing.Sign("http://localhost/generic/", s.ts.URL, time.Now().Add(-time.Hour))
+	s.Require().Nil(err)
+	request = httptest.NewRequest("POST", expired, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "expired signatures should be rejected")
+	s.Nil(s.Call)
+}
+
+func (s *RewriteTests) TestGenericRegistration() {
+	gw := gateway.Generic{Enabled: true}
+	gw.Registrations.Enabled = true
+	s.Require().False(gw.Defaults())
+	register := gw.Routes()["/generic/register/"]
+
+	request := httptest.NewRequest("POST", "/generic/register?e="+neturl.QueryEscape(s.ts.URL), nil)
+	gw.Routes()["/generic/register"](s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode)
+	reg := struct{ ID, Endpoint, Secret string }{}
+	s.Require().Nil(json.NewDecoder(s.Resp.Body).Decode(&reg))
+	s.Equal("http://example.com/generic/r/"+reg.ID, reg.Endpoint)
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", reg.Endpoint, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal("msg", string(s.CallBody))
+
+	s.resetTest()
+	request = httptest.NewRequest("DELETE", "/generic/register/"+reg.ID, nil)
+	register(s.Resp, request)
+	s.Equal(404, s.Resp.Result().StatusCode, "unregistering should need the secret")
+
+	s.resetTest()
+	request.Header.Set("Authorization", "Bearer "+reg.Secret)
+	register(s.Resp, request)
+	s.Equal(204, s.Resp.Result().StatusCode)
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", reg.Endpoint, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(404, s.Resp.Result().StatusCode, "unregistered id should be unknown")
+	s.Nil(s.Call)
+}
+
+func (s *RewriteTests) TestRegistrationLimit() {
+	gw := gateway.Generic{Enabled: true}
+	gw.Registrations = gateway.Registrations{Enabled: true, Store: "file", Path: filepath.Join(s.T().TempDir(), "registrations.json"), Max: 1}
+	s.Require().False(gw.Defaults())
+
+	request := httptest.NewRequest("POST", "/generic/register?e="+neturl.QueryEscape(s.ts.URL), nil)
+	gw.Routes()["/generic/register"](s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode)
+
+	s.resetTest()
+	gw.Routes()["/generic/register"](s.Resp, request)
+	s.Equal(503, s.Resp.Result().StatusCode, "registrations beyond the limit should be refused")
+}
+
+func (s *RewriteTests) TestTrustedProxies() {
+	gw := gateway.Generic{Enabled: true}
+	gw.Registrations.Enabled = true
+	s.Require().False(gw.Defaults())
+	defer gateway.SetTrustedProxies(nil)
+
+	register := func() string {
+		s.resetTest()
+		request := httptest.NewRequest("POST", "/generic/register?e="+neturl.QueryEscape(s.ts.URL), nil)
+		request.Header.Set("X-Forwarded-Proto", "https")
+		gw.Routes()["/generic/register"](s.Resp, request)
+		s.Require().Equal(201, s.Resp.Result().StatusCode)
+		reg := struct{ Endpoint string }{}
+		s.Require().Nil(json.NewDecoder(s.Resp.Body).Decode(&reg))
+		return reg.Endpoint
+	}
+
+	s.True(strings.HasPrefix(register(), "http://"), "X-Forwarded-Proto should be ignored without trusted proxies")
+
+	s.Require().Nil(gateway.SetTrustedProxies([]string{"198.51.100.7"}))
+	s.True(strings.HasPrefix(register(), "http://"), "X-Forwarded-Proto should be ignored from other addresses")
+
+	s.Require().Nil(gateway.SetTrustedProxies([]string{"198.51.100.7", "192.0.2.0/24"}))
+	s.True(strings.HasPrefix(register(), "https://"), "X-Forwarded-Proto should be honoured from trusted proxies")
+
+	s.NotNil(gateway.SetTrustedProxies([]string{"proxy.example.com"}))
+}
+
+func (s *RewriteTests) TestGenericRegistrationPolicy() {
+	gw := gateway.Generic{Enabled: true}
+	gw.Registrations.Enabled = true
+	gw.Signing.Required = true
+	gw.Signing.Keys = map[string]string{"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+	gw.Signing.KeyID = "k1"
+	s.Require().False(gw.Defaults())
+	register := gw.Routes()["/generic/register"]
+
+	request := httptest.NewRequest("POST", "/generic/register?e="+neturl.QueryEscape(s.ts.URL), nil)
+	register(s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "unsigned endpoints should not be registered")
+
+	s.resetTest()
+	signed, err := gw.Signing.Sign("http://localhost/generic/register", s.ts.URL, time.Now().Add(time.Hour))
+	s.Require().Nil(err)
+	request = httptest.NewRequest("POST", signed, nil)
+	register(s.Resp, request)
+	s.Require().Equal(201, s.Resp.Result().StatusCode)
+	reg := struct{ ID, Endpoint string }{}
+	s.Require().Nil(json.NewDecoder(s.Resp.Body).Decode(&reg))
+	s.Contains(reg.Endpoint, "sig=", "registration URLs should be signed")
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", reg.Endpoint, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/r/"+reg.ID, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "unsigned registration URLs should be rejected")
+	s.Nil(s.Call)
+
+	opaque := gateway.Generic{
+		Enabled:     true,
+		Opaque:      true,
+		OpaqueKeys:  map[string]string{"k": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="},
+		OpaqueKeyID: "k",
+		TokenSecret: "0123456789abcdef",
+	}
+	opaque.Registrations.Enabled = true
+	s.Require().False(opaque.Defaults())
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/register?e="+neturl.QueryEscape(s.ts.URL), nil)
+	opaque.Routes()["/generic/register"](s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "raw endpoints should not be registered in opaque mode")
+}
+
+func (s *RewriteTests) TestGenericPathEndpoint() {
+	gw := gateway.Generic{Enabled: true}
+	s.Require().False(gw.Defaults())
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(s.ts.URL + "/up"))
+	request := httptest.NewRequest("POST", "/generic/"+encoded+"/extra/segment", bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal("/up/extra/segment", s.Call.URL.Path)
+	s.Equal("msg", string(s.CallBody))
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/"+encoded+"==", bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(400, s.Resp.Result().StatusCode, "padded base64 should be rejected")
+	s.Nil(s.Call)
+
+	s.resetTest()
+	encoded = base64.RawURLEncoding.EncodeToString([]byte("unix:///run/foo"))
+	request = httptest.NewRequest("POST", "/generic/"+encoded, bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(400, s.Resp.Result().StatusCode, "non http endpoints should be rejected")
+	s.Nil(s.Call)
+}
+
+func (s *RewriteTests) TestGenericWebPushHeaders() {
+	gw := gateway.Generic{Enabled: true}
+	s.Require().False(gw.Defaults())
+
+	request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	request.Header.Set("TTL", "604800")
+	request.Header.Set("Urgency", "high")
+	request.Header.Set("Topic", "new_messages")
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal([]string{"86400"}, s.Call.Header.Values("TTL"), "TTL should be clamped")
+	s.Equal([]string{"high"}, s.Call.Header.Values("Urgency"))
+	s.Equal([]string{"new_messages"}, s.Call.Header.Values("Topic"))
+	s.Equal([]string{"aes128gcm"}, s.Call.Header.Values("Content-Encoding"))
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	request.Header.Set("TTL", "60")
+	handle(&gw)(s.Resp, request)
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal([]string{"60"}, s.Call.Header.Values("TTL"))
+	s.Equal([]string{"normal"}, s.Call.Header.Values("Urgency"))
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	request.Header.Set("Urgency", "urgent")
+	handle(&gw)(s.Resp, request)
+	s.Equal(400, s.Resp.Result().StatusCode, "invalid urgency should be rejected")
+	s.Nil(s.Call)
+}
+
+func (s *RewriteTests) TestGenericStrictEncryption() {
+	gw := gateway.Generic{Enabled: true, StrictEncryption: true}
+	s.Require().False(gw.Defaults())
+
+	request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("plaintext message"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(400, s.Resp.Result().StatusCode, "plaintext should be rejected")
+	s.Nil(s.Call)
+
+	s.resetTest()
+	key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	body := make([]byte, 16)
+	rand.Read(body)
+	body = append(body, 0, 0, 16, 0, 65)
+	body = append(body, key.PublicKey().Bytes()...)
+	ciphertext := make([]byte, 42)
+	rand.Read(ciphertext)
+	body = append(body, ciphertext...)
+	request = httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewReader(body))
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "aes128gcm should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal(body, s.CallBody)
+}
+
 func (s *RewriteTests) TestMatrixRejectedBadIP() {
 	// Setup forbiden web push endpoint
 	s.SetupTestServer(201, false, false)
@@ -155,8 +520,12 @@ func (s *RewriteTests) TestMatrixRejectedBadIP() {
 
 	url := s.ts.URL
 	content := `{"notification":{"devices":[{"pushkey":"` + url + `"}], "counts":{"unread":1}}}`
-	request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
-	handle(&matrix)(s.Resp, request)
+	// The breaker opens after FailureThreshold failures
+	for i := 0; i < config.Config.Cache.FailureThreshold; i++ {
+		s.resetTest()
+		request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
+		handle(&matrix)(s.Resp, request)
+	}
 
 	//resp
 	s.Equal(200, s.Resp.Result().StatusCode, "request should be valid")
@@ -171,8 +540,12 @@ func (s *RewriteTests) TestMatrixRejectedUnsupportedProtocol() {
 
 	url := "unix://foo"
 	content := `{"notification":{"devices":[{"pushkey":"` + url + `"}], "counts":{"unread":1}}}`
-	request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
-	handle(&matrix)(s.Resp, request)
+	// The breaker opens after FailureThreshold failures
+	for i := 0; i < config.Config.Cache.FailureThreshold; i++ {
+		s.resetTest()
+		request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
+		handle(&matrix)(s.Resp, request)
+	}
 
 	//resp
 	s.Equal(200, s.Resp.Result().StatusCode, "request should be valid")
@@ -187,8 +560,12 @@ func (s *RewriteTests) TestMatrixRejectedLookupNoHost() {
 
 	url := "http://doesnotexist.unifiedpush.org"
 	content := `{"notification":{"devices":[{"pushkey":"` + url + `"}], "counts":{"unread":1}}}`
-	request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
-	handle(&matrix)(s.Resp, request)
+	// The breaker opens after FailureThreshold failures
+	for i := 0; i < config.Config.Cache.FailureThreshold; i++ {
+		s.resetTest()
+		request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
+		handle(&matrix)(s.Resp, request)
+	}
 
 	//resp
 	s.Equal(200, s.Resp.Result().StatusCode, "request should be valid")
@@ -200,6 +577,9 @@ func (s *RewriteTests) TestMatrixRejectedLookupNoHost() {
 }
 
 func (s *RewriteTests) TestMatrixRejectedTimeout() {
+	limits := config.Config.Cache
+	defer func() { config.Config.Cache = limits }()
+	config.Config.Cache.FailureThreshold = 1
 	// Setup allowed Web Push endpoint who timeout
 	s.SetupTestServer(201, true, true)
 	matrix := gateway.Matrix{}
@@ -218,6 +598,234 @@ func (s *RewriteTests) TestMatrixRejectedTimeout() {
 	s.Equal(TemporaryUnavailable, getEndpointStatus(u))
 }
 
+func (s *RewriteTests) TestCacheBounded() {
+	limits := config.Config.Cache
+	defer func() { config.Config.Cache = limits }()
+	config.Config.Cache.MaxEntries = 10
+	config.Config.Cache.HostThreshold = -1
+
+	config.Config.Cache.FailureThreshold = 1
+
+	c := newBoundedCache()
+	for i := 0; i < 20; i++ {
+		c.failure(fmt.Sprint("https://example.org/", i), "https://example.org", Refused, "status 404")
+	}
+	stats := c.getStats()
+	s.Equal(10, stats.Entries)
+	s.Equal(uint64(10), stats.Evictions)
+	_, found := c.get("https://example.org/0")
+	s.False(found, "oldest entry should be evicted")
+	status, found := c.get("https://example.org/19")
+	s.True(found)
+	s.Equal(Refused, status)
+}
+
+func (s *RewriteTests) TestCacheHostAggregation() {
+	limits := config.Config.Cache
+	defer func() { config.Config.Cache = limits }()
+	config.Config.Cache.HostThreshold = 5
+	config.Config.Cache.FailureThreshold = 1
+
+	c := newBoundedCache()
+	for i := 0; i < 5; i++ {
+		c.failure(fmt.Sprint("https://example.org/gone", i), "https://example.org", Refused, "status 404")
+	}
+	s.Equal(uint64(0), c.getStats().Aggregations, "gone endpoints should not count toward the host")
+
+	for i := 0; i < 5; i++ {
+		c.failure(fmt.Sprint("https://example.org/", i), "https://example.org", TemporaryUnavailable, "status 503")
+	}
+	stats := c.getStats()
+	s.Equal(6, stats.Entries, "gone endpoints should be kept")
+	s.Equal(uint64(1), stats.Aggregations)
+	status, found := c.get("host:https://example.org")
+	s.True(found)
+	s.Equal(TemporaryUnavailable, status)
+	status, _ = c.get("https://example.org/gone0")
+	s.Equal(Refused, status)
+}
+
+func (s *RewriteTests) TestGenericGoneEndpointsDontBlockHost() {
+	s.ts.Close()
+	s.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/gone/") {
+			w.WriteHeader(404)
+			return
+		}
+		s.Call = r
+		w.WriteHeader(201)
+	}))
+	u, _ := neturl.Parse(s.ts.URL)
+	config.Config.Gateway.AllowedHosts = []string{u.Host}
+	gw := gateway.Generic{}
+	gw.Defaults()
+
+	for i := 0; i < config.Config.Cache.HostThreshold; i++ {
+		s.resetTest()
+		request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(fmt.Sprint(s.ts.URL, "/gone/", i)), bytes.NewBufferString("msg"))
+		handle(&gw)(s.Resp, request)
+		s.Require().Equal(410, s.Resp.Result().StatusCode)
+	}
+
+	s.resetTest()
+	request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL+"/up"), bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode, "gone endpoints should not block the host")
+	s.NotNil(s.Call)
+}
+
+func (s *RewriteTests) TestMatrixProbeAfterCoolDown() {
+	u, _ := neturl.Parse(s.ts.URL)
+	refuseEndpoint(u)
+	s.Equal(Refused, getEndpointStatus(u))
+
+	// End the cool-down, the next request is a probe
+	endpointCache.mu.Lock()
+	endpointCache.items[u.String()].Value.(*cacheEntry).breaker.openUntil = time.Now()
+	endpointCache.mu.Unlock()
+
+	matrix := gateway.Matrix{}
+	content := `{"notification":{"devices":[{"pushkey":"` + s.ts.URL + `"}], "counts":{"unread":1}}}`
+	request := httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
+	handle(&matrix)(s.Resp, request)
+
+	body, _ := io.ReadAll(s.Resp.Body)
+	s.Equal(`{"rejected":[]}`, string(body))
+	// A successful probe closes the breaker
+	s.Require().NotNil(s.Call, "probe request should be made")
+	_, found := endpointCache.get(u.String())
+	s.False(found, "breaker should be closed")
+}
+
+func (s *RewriteTests) TestBreakerHalfOpen() {
+	limits := config.Config.Cache
+	b := breaker{}
+	now := time.Now()
+	for i := 0; i < limits.FailureThreshold; i++ {
+		s.Equal(NotCached, b.allow(now))
+		b.failure(now, Refused, "status 404", limits)
+	}
+	s.Equal(Open, b.state)
+	s.Equal(Refused, b.allow(now))
+
+	// One probe after the cool-down
+	now = now.Add(limits.CoolDownDuration())
+	s.Equal(NotCached, b.allow(now))
+	s.Equal(HalfOpen, b.state)
+	s.Equal(Refused, b.allow(now), "only one probe at a time")
+
+	// A failing probe doubles the cool-down
+	b.failure(now, Refused, "status 404", limits)
+	s.Equal(Open, b.state)
+	s.Equal(2*limits.CoolDownDuration(), b.cooldown)
+
+	// A probe without result opens the breaker for the same cool-down
+	now = now.Add(b.cooldown)
+	s.Equal(NotCached, b.allow(now))
+	b.abort(now)
+	s.Equal(Open, b.state)
+	s.Equal(2*limits.CoolDownDuration(), b.cooldown)
+	s.Equal(Refused, b.allow(now))
+}
+
+func (s *RewriteTests) TestGenericHostProbeGone() {
+	s.SetupTestServer(404, true, false)
+	u, _ := neturl.Parse(s.ts.URL + "/gone")
+	for i := 0; i < config.Config.Cache.FailureThreshold; i++ {
+		hostFailure(u, TemporaryUnavailable, "timeout")
+	}
+	hostKey := "host:" + getHost(u)
+	s.Require().Equal(TemporaryUnavailable, getEndpointStatus(u))
+	// End the cool-down, the next request is a probe
+	endpointCache.mu.Lock()
+	endpointCache.items[hostKey].Value.(*cacheEntry).breaker.openUntil = time.Now()
+	endpointCache.mu.Unlock()
+
+	gw := gateway.Generic{}
+	gw.Defaults()
+	request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(u.String()), bytes.NewBufferString("msg"))
+	handle(&gw)(s.Resp, request)
+	s.Require().NotNil(s.Call, "probe request should be made")
+	s.Equal(410, s.Resp.Result().StatusCode)
+	_, found := endpointCache.get(hostKey)
+	s.False(found, "a host answering the probe should be closed")
+}
+
+func (s *RewriteTests) TestGenericProbeSettled() {
+	s.ts.Close()
+	for _, code := range []int{413, 401} {
+		s.SetupTestServer(code, true, false)
+		u, _ := neturl.Parse(s.ts.URL)
+		refuseEndpoint(u)
+		// End the cool-down, the next request is a probe
+		endpointCache.mu.Lock()
+		endpointCache.items[u.String()].Value.(*cacheEntry).breaker.openUntil = time.Now()
+		endpointCache.mu.Unlock()
+
+		gw := gateway.Generic{}
+		gw.Defaults()
+		request := httptest.NewRequest("POST", "/generic/?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+		handle(&gw)(s.Resp, request)
+		s.Require().NotNil(s.Call, "probe request should be made")
+		_, found := endpointCache.get(u.String())
+		s.False(found, "a probe answered with %d should close the breaker", code)
+		s.ts.Close()
+	}
+}
+
+func (s *RewriteTests) TestAdminCache() {
+	config.Config.Admin.Token = "0123456789abcdef"
+	defer func() { config.Config.Admin.Token = "" }()
+	u, _ := neturl.Parse(s.ts.URL + "/endpoint")
+	refuseEndpoint(u)
+	router := adminRouter()
+
+	request := httptest.NewRequest("GET", "/cache/lookup?url="+neturl.QueryEscape(u.String()), nil)
+	router.ServeHTTP(s.Resp, request)
+	s.Equal(401, s.Resp.Result().StatusCode, "request should need the token")
+
+	s.resetTest()
+	request.Header.Set("Authorization", "Bearer "+config.Config.Admin.Token)
+	router.ServeHTTP(s.Resp, request)
+	s.Equal(200, s.Resp.Result().StatusCode)
+	body, _ := io.ReadAll(s.Resp.Body)
+	s.Contains(string(body), `"status":"refused"`)
+	s.Contains(string(body), `"openUntil":`)
+
+	closed, _ := neturl.Parse(s.ts.URL + "/closed")
+	endpointFailure(closed, TemporaryUnavailable, "status 503")
+	s.resetTest()
+	request = httptest.NewRequest("GET", "/cache/lookup?url="+neturl.QueryEscape(closed.String()), nil)
+	request.Header.Set("Authorization", "Bearer "+config.Config.Admin.Token)
+	router.ServeHTTP(s.Resp, request)
+	body, _ = io.ReadAll(s.Resp.Body)
+	s.Contains(string(body), `"state":"closed"`)
+	s.NotContains(string(body), `"openUntil":`, "closed breakers have no end of cool-down")
+
+	s.resetTest()
+	request = httptest.NewRequest("DELETE", "/cache?url="+neturl.QueryEscape(u.String()), nil)
+	request.Header.Set("Authorization", "Bearer "+config.Config.Admin.Token)
+	router.ServeHTTP(s.Resp, request)
+	s.Equal(200, s.Resp.Result().StatusCode)
+	body, _ = io.ReadAll(s.Resp.Body)
+	s.Equal(`{"purged":1}`, string(body))
+
+	s.resetTest()
+	request = httptest.NewRequest("GET", "/cache", nil)
+	request.Header.Set("Authorization", "Bearer "+config.Config.Admin.Token)
+	router.ServeHTTP(s.Resp, request)
+	body, _ = io.ReadAll(s.Resp.Body)
+	s.Contains(string(body), `"stats":{"entries":`, "stats keys should be lowercase")
+	s.Equal(NotCached, getEndpointStatus(u))
+}
+
+// Opens the breaker of the endpoint with failures
+func refuseEndpoint(u *neturl.URL) {
+	for i := 0; i < config.Config.Cache.FailureThreshold; i++ {
+		endpointFailure(u, Refused, "status 404")
+	}
+}
+
 func (s *RewriteTests) TestMatrixResp() {
 	//TODO
 }
@@ -247,6 +855,572 @@ this is
 my msg`, string(s.CallBody), "body should match")
 }
 
+func (s *RewriteTests) TestAesgcmGatewayKeyID() {
+	gw := gateway.Aesgcm{}
+
+	request := httptest.NewRequest("POST", "/aesgcm?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	request.Header.Add("Content-Encoding", "aesgcm")
+	request.Header.Add("Crypto-Key", `keyid=a; dh=BAAA, keyid=p256dh; dh=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU; p256ecdsa=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU`)
+	request.Header.Add("Encryption", `keyid=p256dh; salt=lngarbyKfMoi9Z75xYXmkg; rs=4096`)
+	handle(&gw)(s.Resp, request)
+
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Equal(`aesgcm
+Encryption: salt="lngarbyKfMoi9Z75xYXmkg"
+Crypto-Key: dh="BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU"
+msg`, string(s.CallBody), "headers should be normalized")
+
+	s.resetTest()
+	request = httptest.NewRequest("POST", "/aesgcm?e="+neturl.QueryEscape(s.ts.URL), bytes.NewBufferString("msg"))
+	request.Header.Add("Content-Encoding", "aesgcm")
+	request.Header.Add("Crypto-Key", `keyid=a; dh=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU`)
+	request.Header.Add("Encryption", `keyid=p256dh; salt=lngarbyKfMoi9Z75xYXmkg`)
+	handle(&gw)(s.Resp, request)
+	s.Equal(400, s.Resp.Result().StatusCode, "keyid should match")
+	s.Nil(s.Call)
+}
+
+func (s *RewriteTests) TestAesgcmRegistrationSigned() {
+	gw := gateway.Aesgcm{Enabled: true}
+	gw.Registrations.Enabled = true
+	gw.Signing.Required = true
+	gw.Signing.Keys = map[string]string{"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+	gw.Signing.KeyID = "k1"
+	s.Require().False(gw.Defaults())
+	register := gw.Routes()["/aesgcm/register"]
+	push := func(path string) {
+		request := httptest.NewRequest("POST", path, bytes.NewBufferString("encrypted message"))
+		request.Header.Set("Content-Encoding", "aesgcm")
+		request.Header.Set("Encryption", "salt=AAAAAAAAAAAAAAAAAAAAAA")
+		request.Header.Set("Crypto-Key", "dh=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU")
+		handle(&gw)(s.Resp, request)
+	}
+
+	request := httptest.NewRequest("POST", "/aesgcm/register?e="+neturl.QueryEscape(s.ts.URL), nil)
+	register(s.Resp, request)
+	s.Equal(403, s.Resp.Result().StatusCode, "unsigned endpoints should not be registered")
+
+	s.resetTest()
+	signed, err := gw.Signing.Sign("http://localhost/aesgcm/register", s.ts.URL, time.Time{})
+	s.Require().Nil(err)
+	request = httptest.NewRequest("POST", signed, nil)
+	register(s.Resp, request)
+	s.Require().Equal(201, s.Resp.Result().StatusCode)
+	reg := struct{ ID, Endpoint string }{}
+	s.Require().Nil(json.NewDecoder(s.Resp.Body).Decode(&reg))
+
+	s.resetTest()
+	push("/aesgcm?r=" + reg.ID)
+	s.Equal(403, s.Resp.Result().StatusCode, "unsigned registration URLs should be rejected")
+	s.Nil(s.Call)
+
+	s.resetTest()
+	push(reg.Endpoint)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.NotNil(s.Call, "No request made")
+}
+
+func (s *RewriteTests) TestAesgcmTranscode() {
+	gw := gateway.Aesgcm{Enabled: true, Transcode: true}
+	gw.Registrations.Enabled = true
+	s.Require().False(gw.Defaults())
+
+	private, _ := ecdh.P256().GenerateKey(rand.Reader)
+	keys := ece.Keys{Private: private, Auth: make([]byte, ece.AuthLen)}
+	rand.Read(keys.Auth)
+	push := func(path string) {
+		headers, body, err := ece.EncryptAesgcm([]byte("I am the walrus"), private.PublicKey(), keys.Auth, ece.Options{})
+		s.Require().Nil(err)
+		request := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		request.Header.Set("Content-Encoding", "aesgcm")
+		request.Header.Set("Encryption", headers.Encryption())
+		request.Header.Set("Crypto-Key", headers.CryptoKey()+"; p256ecdsa=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU")
+		request.Header.Set("Authorization", "WebPush jwt")
+		handle(&gw)(s.Resp, request)
+	}
+
+	push("/aesgcm?e=" + neturl.QueryEscape(s.ts.URL) + "&k=" + keys.String())
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal("aes128gcm", s.Call.Header.Get("Content-Encoding"))
+	s.Equal("vapid t=jwt, k=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU", s.Call.Header.Get("Authorization"))
+	plaintext, err := ece.DecryptWebPush(s.CallBody, keys)
+	s.Require().Nil(err)
+	s.Equal("I am the walrus", string(plaintext))
+
+	s.resetTest()
+	request := httptest.NewRequest("POST", "/aesgcm/register?e="+neturl.QueryEscape(s.ts.URL)+"&k="+keys.String(), nil)
+	gw.Routes()["/aesgcm/register"](s.Resp, request)
+	s.Equal(201, s.Resp.Result().StatusCode)
+	reg := struct{ ID, Endpoint string }{}
+	s.Require().Nil(json.NewDecoder(s.Resp.Body).Decode(&reg))
+	s.Equal("http://example.com/aesgcm?r="+reg.ID, reg.Endpoint)
+
+	s.resetTest()
+	push(reg.Endpoint)
+	s.Equal(201, s.Resp.Result().StatusCode, "request should be valid")
+	s.Require().NotNil(s.Call, "No request made")
+	plaintext, err = ece.DecryptWebPush(s.CallBody, keys)
+	s.Require().Nil(err)
+	s.Equal("I am the walrus", string(plaintext))
+
+	s.resetTest()
+	other := ece.Keys{Private: private, Auth: make([]byte, ece.AuthLen)}
+	push("/aesgcm?e=" + neturl.QueryEscape(s.ts.URL) + "&k=" + other.String())
+	s.Equal(400, s.Resp.Result().StatusCode, "message should not be decrypted with other keys")
+	s.Nil(s.Call)
+}
+
+func (s *RewriteTests) TestTestPush() {
+	private, _ := ecdh.P256().GenerateKey(rand.Reader)
+	keys := ece.Keys{Private: private, Auth: make([]byte, ece.AuthLen)}
+	vapidKey, _ := vapid.GenerateKey(rand.Reader)
+	t := testPush{endpoint: s.ts.URL, receiver: private.PublicKey(), auth: keys.Auth, message: "test", vapidKey: vapidKey, subject: vapid.DefaultSubject, via: "direct", ttl: 60, urgency: "high"}
+
+	out := &bytes.Buffer{}
+	s.Require().Nil(t.send(out))
+	s.Contains(out.String(), "1. "+s.ts.URL+": 201 Created")
+	s.Require().NotNil(s.Call, "No request made")
+	s.Equal("high", s.Call.Header.Get("Urgency"))
+	s.True(strings.HasPrefix(s.Call.Header.Get("Authorization"), "vapid t="))
+	plaintext, err := ece.DecryptWebPush(s.CallBody, keys)
+	s.Require().Nil(err)
+	s.Equal("test", string(plaintext))
+
+	s.resetTest()
+	config.Config.Gateway.Generic = gateway.Generic{Enabled: true}
+	defer func() { config.Config.Gateway.Generic = gateway.Generic{} }()
+	s.Require().False(config.Config.Gateway.Generic.Defaults())
+	t.via = "generic"
+	out.Reset()
+	s.Require().Nil(t.send(out))
+	s.Contains(out.String(), "1. generic handler, /generic/?e="+neturl.QueryEscape(s.ts.URL)+": 201 Created")
+	s.Contains(out.String(), "2. "+s.ts.URL+": 201 Created")
+	plaintext, err = ece.DecryptWebPush(s.CallBody, keys)
+	s.Require().Nil(err)
+	s.Equal("test", string(plaintext))
+
+	s.resetTest()
+	config.Config.Gateway.Generic.Signing = gateway.SignedURLs{Required: true, Keys: map[string]string{"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}, KeyID: "k1"}
+	s.Require().False(config.Config.Gateway.Generic.Defaults())
+	out.Reset()
+	s.Require().Nil(t.send(out))
+	s.Contains(out.String(), "sig=", "the gateway URL should be signed")
+	s.Contains(out.String(), "2. "+s.ts.URL+": 201 Created")
+
+	s.resetTest()
+	config.Config.Gateway.Generic = gateway.Generic{
+		Enabled:     true,
+		Opaque:      true,
+		OpaqueKeys:  map[string]string{"k": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="},
+		OpaqueKeyID: "k",
+		TokenSecret: "0123456789abcdef",
+	}
+	s.Require().False(config.Config.Gateway.Generic.Defaults())
+	out.Reset()
+	s.Require().Nil(t.send(out))
+	s.Contains(out.String(), "1. generic handler, /generic/?t=", "the gateway URL should be a token")
+	s.Contains(out.String(), "2. "+s.ts.URL+": 201 Created")
+
+	t.via = "aesgcm"
+	s.NotNil(t.send(out), "aesgcm handler is disabled")
+
+	t.via = "generic"
+	t.endpoint = "not-an-endpoint"
+	_, _, err = t.request()
+	s.NotNil(err, "the VAPID audience of the endpoint is needed")
+}
+
+func (s *RewriteTests) TestFCMWebPushOptions() {
+	fcm := rewrite.FCM{Enabled: true, CredentialsPath: "creds.json"}
+	s.Require().False(fcm.Defaults())
+	fcm.ConfigFactory = testConfigFactory(s.ts.URL)
+
+	android := func(header http.Header) map[string]interface{} {
+		request := httptest.NewRequest("POST", "/FCM?v2&token=tok&instance=inst", bytes.NewBufferString("msg"))
+		request.Header = header
+		reqs, err := fcm.Req([]byte("msg"), *request)
+		s.Require().Nil(err)
+		var payload struct {
+			Message map[string]interface{}
+		}
+		s.Require().Nil(json.NewDecoder(reqs[0].Body).Decode(&payload))
+		s.Equal("tok", payload.Message["token"])
+		if android, ok := payload.Message["android"]; ok {
+			return android.(map[string]interface{})
+		}
+		return nil
+	}
+
+	s.Nil(android(http.Header{}), "no option should be sent without WebPush headers")
+	s.Equal(map[string]interface{}{"ttl": "60s", "priority": "HIGH", "collapse_key": "news"},
+		android(http.Header{"Ttl": {"60"}, "Urgency": {"high"}, "Topic": {"news"}}))
+	s.Equal(map[string]interface{}{"priority": "NORMAL"}, android(http.Header{"Urgency": {"very-low"}}))
+	s.Equal(map[string]interface{}{"ttl": "2419200s"}, android(http.Header{"Ttl": {"99999999"}}))
+
+	request := httptest.NewRequest("POST", "/FCM?v2&token=tok&instance=inst", bytes.NewBufferString("msg"))
+	request.Header.Set("Urgency", "urgent")
+	_, err := fcm.Req([]byte("msg"), *request)
+	s.Require().NotNil(err)
+	s.Equal(400, err.(*utils.ProxyError).Code)
+}
+
+func (s *RewriteTests) TestFCMParts() {
+	fcm := rewrite.FCM{Enabled: true, CredentialsPath: "creds.json"}
+	s.Require().False(fcm.Defaults())
+	fcm.ConfigFactory = testConfigFactory(s.ts.URL)
+
+	parts := func(size int) ([]map[string]string, error) {
+		body := make([]byte, size)
+		rand.Read(body)
+		request := httptest.NewRequest("POST", "/FCM?v2&token=tok&instance=inst", bytes.NewReader(body))
+		reqs, err := fcm.Req(body, *request)
+		if err != nil {
+			return nil, err
+		}
+		var b string
+		var out []map[string]string
+		for _, req := range reqs {
+			var payload struct {
+				Message struct {
+					Data map[string]string
+				}
+			}
+			s.Require().Nil(json.NewDecoder(req.Body).Decode(&payload))
+			data := payload.Message.Data
+			size := 0
+			for k, v := range data {
+				size += len(k) + len(v)
+			}
+			s.LessOrEqual(size, 3800, "part too large for FCM")
+			s.Equal("inst", data["i"])
+			b += data["b"]
+			out = append(out, data)
+		}
+		s.Equal(base64.StdEncoding.EncodeToString(body), b)
+		return out, nil
+	}
+
+	out, err := parts(1000)
+	s.Require().Nil(err)
+	s.Len(out, 1)
+	s.NotContains(out[0], "m")
+
+	out, err = parts(9000)
+	s.Require().Nil(err)
+	s.Require().Len(out, 4)
+	for i, data := range out {
+		s.Equal(out[0]["m"], data["m"])
+		s.Equal(fmt.Sprint(i+1), data["s"])
+		s.Equal("4", data["n"])
+	}
+
+	_, err = parts(12000)
+	s.Require().NotNil(err)
+	s.Equal(413, err.(*utils.ProxyError).Code)
+}
+
+func (s *RewriteTests) TestFCMPartialFailure() {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Write([]byte(`{"name":"msg1"}`))
+			return
+		}
+		w.WriteHeader(429)
+		w.Write([]byte(`{"error":{"status":"RESOURCE_EXHAUSTED"}}`))
+	}))
+	defer ts.Close()
+	fcm := rewrite.FCM{Enabled: true, CredentialsPath: "creds.json"}
+	s.Require().False(fcm.Defaults())
+	fcm.ConfigFactory = testConfigFactory(ts.URL)
+
+	body := make([]byte, 4000)
+	request := httptest.NewRequest("POST", "/FCM?v2&token=tok&instance=inst", bytes.NewReader(body))
+	handle(&fcm)(s.Resp, request)
+	s.Equal(2, calls)
+	s.Equal(429, s.Resp.Code)
+	s.Contains(s.Resp.Body.String(), "part 2/2 failed, 1 sent")
+	s.Equal("60", s.Resp.Header().Get("Retry-After"))
+}
+
+func (s *RewriteTests) TestFCMErrors() {
+	fcm := rewrite.FCM{}
+	fcmError := func(code int, status string, errorCode string) string {
+		return fmt.Sprintf(`{"error":{"code":%d,"message":"msg","status":"%s","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"%s"}]}}`, code, status, errorCode)
+	}
+	for _, c := range []struct {
+		code       int
+		body       string
+		retryAfter string
+		expected   int
+		expRetry   string
+	}{
+		{404, fcmError(404, "NOT_FOUND", "UNREGISTERED"), "", 410, ""},
+		{400, fcmError(400, "INVALID_ARGUMENT", "INVALID_ARGUMENT"), "", 400, ""},
+		{403, fcmError(403, "PERMISSION_DENIED", "SENDER_ID_MISMATCH"), "", 403, ""},
+		{429, fcmError(429, "RESOURCE_EXHAUSTED", "QUOTA_EXCEEDED"), "120", 429, "120"},
+		{429, fcmError(429, "RESOURCE_EXHAUSTED", "QUOTA_EXCEEDED"), "", 429, "60"},
+		{503, fcmError(503, "UNAVAILABLE", "UNAVAILABLE"), "10", 502, "10"},
+		{500, fcmError(500, "INTERNAL", "INTERNAL"), "", 502, ""},
+		{401, `{"error":{"code":401,"status":"UNAUTHENTICATED"}}`, "", 502, ""},
+		{401, fcmError(401, "UNAUTHENTICATED", "THIRD_PARTY_AUTH_ERROR"), "", 502, ""},
+		{404, `{"error":{"code":404,"status":"NOT_FOUND"}}`, "", 410, ""},
+		{400, "not json", "", 400, ""},
+		{502, "<html>", "", 502, ""},
+	} {
+		resp := &http.Response{
+			StatusCode: c.code,
+			Status:     fmt.Sprint(c.code),
+			Header:     http.Header{},
+			Body:       io.NopCloser(bytes.NewBufferString(c.body)),
+		}
+		if c.retryAfter != "" {
+			resp.Header.Set("Retry-After", c.retryAfter)
+		}
+		perr := fcm.RespCode(resp)
+		s.Equal(c.expected, perr.Code, c.body)
+		s.Equal(c.expRetry, perr.RetryAfter, c.body)
+	}
+}
+
+func (s *RewriteTests) TestProxyRetry() {
+	previous := config.Config.Retry
+	defer func() { config.Config.Retry = previous }()
+	config.Config.Retry.BaseDelay = 1
+
+	calls := 0
+	var retryAfter string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		s.Contains(string(body), `"token":"tok"`, "retries should have the body")
+		if calls < 3 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(503)
+			w.Write([]byte(`{"error":{"status":"UNAVAILABLE"}}`))
+			return
+		}
+		w.Write([]byte(`{"name":"msg"}`))
+	}))
+	defer ts.Close()
+	fcm := rewrite.FCM{Enabled: true, CredentialsPath: "creds.json"}
+	s.Require().False(fcm.Defaults())
+	fcm.ConfigFactory = testConfigFactory(ts.URL)
+	handler := handle(&fcm)
+
+	request := httptest.NewRequest("POST", "/FCM?v2&token=tok&instance=inst", bytes.NewBufferString("msg"))
+	handler(s.Resp, request)
+	s.Equal(3, calls)
+	s.Equal(201, s.Resp.Code)
+
+	calls = 0
+	retryAfter = "3600"
+	s.Resp = httptest.NewRecorder()
+	handler(s.Resp, request)
+	s.Equal(1, calls, "the sender should retry after a long Retry-After")
+	s.Equal(502, s.Resp.Code)
+	s.Equal("3600", s.Resp.Header().Get("Retry-After"))
+
+	calls = 0
+	retryAfter = ""
+	config.Config.Retry.MaxAttempts = 1
+	s.Resp = httptest.NewRecorder()
+	handler(s.Resp, request)
+	s.Equal(1, calls)
+	s.Equal(502, s.Resp.Code)
+}
+
+func (s *RewriteTests) TestRetryDeadline() {
+	calls := 0
+	slow := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if slow {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+	r := newRetrier()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("POST", ts.URL, nil)
+	resp, err := r.do(ctx, normalClient, req)
+	s.Require().Nil(err)
+	resp.Body.Close()
+	s.Equal(1, calls, "no retry should be made after the deadline")
+
+	slow = true
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = r.do(ctx, normalClient, req)
+	s.ErrorIs(err, context.DeadlineExceeded, "attempts should be cancelled at the deadline")
+	s.Less(time.Since(start), 500*time.Millisecond)
+}
+
+func (s *RewriteTests) TestRetryBudget() {
+	r := newRetrier()
+	for i := 0; i < retryReserve; i++ {
+		s.True(r.withdraw())
+	}
+	s.False(r.withdraw(), "budget should be exhausted")
+	for i := 0; i < 5; i++ {
+		r.deposit()
+	}
+	s.True(r.withdraw(), "5 requests should allow a retry, with a budget of 0.2")
+	s.False(r.withdraw())
+}
+
+func (s *RewriteTests) TestFCMLocalEndpoints() {
+	tokens := 0
+	var auth []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			r.ParseForm()
+			s.Equal("urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+			tokens++
+			// Expires immediately, to be refreshed for each request
+			fmt.Fprintf(w, `{"access_token":"token%d","token_type":"Bearer","expires_in":1}`, tokens)
+		case "/v1/projects/local/messages:send":
+			auth = append(auth, r.Header.Get("Authorization"))
+			w.Write([]byte(`{"name":"projects/local/messages/1"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	s.Require().Nil(err)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	creds, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "local",
+		"client_email": "test@local.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    "https://oauth2.googleapis.com/token",
+	})
+	path := s.T().TempDir() + "/creds.json"
+	s.Require().Nil(os.WriteFile(path, creds, 0600))
+
+	fcm := rewrite.FCM{Enabled: true, CredentialsPath: path, BaseUrl: "ftp://localhost"}
+	s.True(fcm.Defaults(), "base URL should be http or https")
+	fcm.BaseUrl = ts.URL + "/"
+	fcm.TokenUrl = ts.URL + "/token"
+	s.Require().False(fcm.Defaults())
+	s.Require().Nil(fcm.Load())
+	handler := handle(&fcm)
+
+	for i := 0; i < 2; i++ {
+		s.Resp = httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/FCM?v2&token=tok&instance=inst", bytes.NewBufferString("msg"))
+		handler(s.Resp, request)
+		s.Equal(201, s.Resp.Code)
+	}
+	s.Equal(2, tokens)
+	s.Equal([]string{"Bearer token1", "Bearer token2"}, auth)
+}
+
+func (s *RewriteTests) TestFCMCredentialsReload() {
+	path := s.T().TempDir() + "/creds.json"
+	s.Require().Nil(os.WriteFile(path, []byte(`{"type":`), 0600))
+	fcm := rewrite.FCM{Enabled: true, CredentialsPath: path}
+	s.Require().False(fcm.Defaults())
+	s.Require().Nil(fcm.Load())
+	s.NotNil(fcm.Health(), "invalid credentials should be reported")
+
+	previous := handlers
+	defer func() { handlers = previous }()
+	handlers = []Handler{&fcm}
+	request := httptest.NewRequest("GET", "/health", nil)
+	healthHandler(s.Resp, request)
+	s.Equal(503, s.Resp.Code)
+	s.Contains(s.Resp.Body.String(), path)
+
+	creds := `{"type":"service_account","project_id":"test","client_email":"test@test.iam.gserviceaccount.com","private_key":"key"}`
+	s.Require().Nil(os.WriteFile(path, []byte(creds), 0600))
+	fcm.Tick()
+	s.Nil(fcm.Health(), "credentials should be reloaded")
+
+	s.Resp = httptest.NewRecorder()
+	healthHandler(s.Resp, request)
+	s.Equal(200, s.Resp.Code)
+
+	disabled := rewrite.FCM{CredentialsPath: s.T().TempDir() + "/disabled.json"}
+	s.Require().Nil(os.WriteFile(disabled.CredentialsPath, []byte(`{"type":`), 0600))
+	disabled.Tick()
+	s.Nil(disabled.Health(), "credentials of a disabled FCM should not be loaded")
+}
+
+func (s *RewriteTests) TestWebPushFCMVapidClaims() {
+	key, _ := vapid.GenerateKey(rand.Reader)
+	encoded, _ := vapid.EncodePriv(*key)
+	path := s.T().TempDir() + "/vapid.key"
+	s.Require().Nil(os.WriteFile(path, []byte(encoded), 0600))
+
+	fcm := rewrite.WebPushFCM{Enabled: true, CredentialsPath: path}
+	fcm.VAPID.Subject = "http://example.org/contact"
+	s.True(fcm.Defaults(), "subject should be mailto: or https:")
+	fcm.VAPID = rewrite.VapidClaims{Subject: "mailto:admin@example.org", Lifetime: 3600}
+	s.Require().False(fcm.Defaults())
+	s.Require().Nil(fcm.Load())
+
+	request := httptest.NewRequest("POST", "/wpfcm?t=token", bytes.NewBufferString("msg"))
+	reqs, err := fcm.Req([]byte("msg"), *request)
+	s.Require().Nil(err)
+	claims, _, err := vapid.ParseAuth(reqs[0].Header.Get("Authorization"))
+	s.Require().Nil(err)
+	s.Equal("mailto:admin@example.org", claims.Sub)
+	s.Equal("https://fcm.googleapis.com", claims.Aud)
+	s.InDelta(time.Now().Add(time.Hour).Unix(), claims.Exp, 5)
+
+	fcm.VAPID.Lifetime = 2 * 86400
+	s.True(fcm.Defaults(), "lifetime should be at most 24h")
+}
+
+func (s *RewriteTests) TestWebPushFCMHostKeys() {
+	dir := s.T().TempDir()
+	paths := map[string]string{}
+	for _, host := range []string{"app1.example.org", "app2.example.org"} {
+		key, _ := vapid.GenerateKey(rand.Reader)
+		encoded, _ := vapid.EncodePriv(*key)
+		paths[host] = dir + "/" + host + ".key"
+		s.Require().Nil(os.WriteFile(paths[host], []byte(encoded), 0600))
+	}
+	fcm := rewrite.WebPushFCM{Enabled: true, CredentialsPaths: paths}
+	s.Require().False(fcm.Defaults())
+	s.Require().Nil(fcm.Load())
+
+	keyOf := func(host string) string {
+		request := httptest.NewRequest("POST", "/wpfcm?t=token", bytes.NewBufferString("msg"))
+		request.Host = host
+		reqs, err := fcm.Req([]byte("msg"), *request)
+		s.Require().Nil(err)
+		_, key, err := vapid.ParseAuth(reqs[0].Header.Get("Authorization"))
+		s.Require().Nil(err)
+		return key
+	}
+	key1 := keyOf("app1.example.org")
+	s.Equal(key1, keyOf("app1.example.org"))
+	s.NotEqual(key1, keyOf("app2.example.org"))
+
+	request := httptest.NewRequest("POST", "/wpfcm?t=token", bytes.NewBufferString("msg"))
+	request.Host = "other.example.org"
+	_, err := fcm.Req([]byte("msg"), *request)
+	s.Require().NotNil(err)
+	s.Equal(404, err.(*utils.ProxyError).Code)
+}
+
 func (s *RewriteTests) TestHealth() {
 	resp, err := http.Get(s.ts.URL + "/health")
 	s.Require().Nil(err)
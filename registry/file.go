@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Journal lines written by the file store before it is compacted again
+const minJournalLines = 1024
+
+// A memory store saved to a file, as a journal of JSON lines appended after
+// every change. The journal is compacted when it opens, on purges, and when
+// it gets much longer than the registrations it holds
+type fileStore struct {
+	*memoryStore
+	path    string
+	journal *os.File
+	// lines written to the journal
+	lines int
+}
+
+// A line of the journal: a registration added or replaced, or deleted
+type journalEntry struct {
+	Registration
+	Deleted bool `json:",omitempty"`
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	if path == "" {
+		return nil, errors.New("registration store path cannot be empty")
+	}
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+	f, err := os.Open(path)
+	if err == nil {
+		err = s.load(f)
+		f.Close()
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return s, s.compact()
+}
+
+// Reads the journal. Its last line is skipped if it can't be parsed: it can
+// be incomplete after a crash during an append. It is dropped when the
+// journal is compacted
+func (s *fileStore) load(f *os.File) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	var lineErr error
+	for line := 1; scanner.Scan(); line++ {
+		if lineErr != nil {
+			return lineErr
+		}
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			lineErr = fmt.Errorf("%s: line %d: %w", s.path, line, err)
+			continue
+		}
+		if e.Deleted {
+			delete(s.registrations, e.ID)
+		} else {
+			s.registrations[e.ID] = e.Registration
+		}
+	}
+	if lineErr != nil {
+		log.Println("Skipping the incomplete last registration of", lineErr)
+	}
+	return scanner.Err()
+}
+
+// Must be called with the lock held. Appends e to the journal
+func (s *fileStore) append(e journalEntry) error {
+	if s.lines >= minJournalLines && s.lines > 2*len(s.registrations) {
+		return s.compact()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := s.journal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.lines++
+	return nil
+}
+
+// Must be called with the lock held. Replaces the journal atomically with
+// one line per registration
+func (s *fileStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range s.registrations {
+		if err := enc.Encode(journalEntry{Registration: r}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	s.journal, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	s.lines = len(s.registrations)
+	return err
+}
+
+func (s *fileStore) Put(r Registration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.registrations[r.ID] = r
+	return s.append(journalEntry{Registration: r})
+}
+
+func (s *fileStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.registrations, id)
+	return s.append(journalEntry{Registration: Registration{ID: id}, Deleted: true})
+}
+
+func (s *fileStore) Purge(now time.Time) (int, error) {
+	n, _ := s.memoryStore.Purge(now)
+	if n == 0 {
+		return 0, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return n, s.compact()
+}
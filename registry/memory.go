@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	lock          sync.RWMutex
+	registrations map[string]Registration
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{registrations: map[string]Registration{}}
+}
+
+func (s *memoryStore) Get(id string) (*Registration, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r, ok := s.registrations[id]
+	if !ok || time.Now().After(r.Expires) {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (s *memoryStore) Put(r Registration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.registrations[r.ID] = r
+	return nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.registrations, id)
+	return nil
+}
+
+func (s *memoryStore) Count() (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.registrations), nil
+}
+
+func (s *memoryStore) Purge(now time.Time) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, r := range s.registrations {
+		if now.After(r.Expires) {
+			delete(s.registrations, id)
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A push endpoint registered on the gateway, pushed to with a short id
+type Registration struct {
+	ID       string
+	Endpoint string
+	// SHA-256 of the secret needed to refresh or delete the registration
+	SecretHash []byte
+	Expires    time.Time
+	// Receiver keys, for gateways that decrypt the messages. Optional
+	Keys string
+}
+
+func (r Registration) CheckSecret(secret string) bool {
+	h := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(h[:], r.SecretHash) == 1
+}
+
+// Returns a new registration for endpoint, with a random id and secret
+func New(endpoint string, ttl time.Duration) (r Registration, secret string, err error) {
+	id, err := randomString(16)
+	if err != nil {
+		return
+	}
+	secret, err = randomString(32)
+	if err != nil {
+		return
+	}
+	h := sha256.Sum256([]byte(secret))
+	r = Registration{ID: id, Endpoint: endpoint, SecretHash: h[:], Expires: time.Now().Add(ttl)}
+	return
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type Store interface {
+	// Returns nil if id is unknown or expired
+	Get(id string) (*Registration, error)
+	// Adds or replaces a registration
+	Put(r Registration) error
+	Delete(id string) error
+	// Removes expired registrations, and returns how many were removed
+	Purge(now time.Time) (int, error)
+	// Returns the number of registrations, including the expired ones
+	// that weren't purged yet
+	Count() (int, error)
+}
+
+type openStore struct {
+	Store
+	// the gateway using the store
+	owner string
+}
+
+var stores = map[string]openStore{}
+var storesLock sync.Mutex
+
+// Opens the store of kind memory, file or sqlite of the gateway owner. path
+// is ignored for memory stores. Stores are opened once, and shared between
+// config reloads, but never between gateways: registration ids of a gateway
+// must not be valid on another one
+func Open(owner string, kind string, path string) (Store, error) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	key := kind + ":" + path
+	if kind == "memory" {
+		key = kind + ":" + owner
+	}
+	if s, ok := stores[key]; ok {
+		if s.owner != owner {
+			return nil, fmt.Errorf("registration store %s is already used by the %s gateway", path, s.owner)
+		}
+		return s.Store, nil
+	}
+	var s Store
+	var err error
+	switch kind {
+	case "memory":
+		s = newMemoryStore()
+	case "file":
+		s, err = newFileStore(path)
+	case "sqlite":
+		s, err = newSqliteStore(path)
+	default:
+		err = fmt.Errorf("unknown registration store %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stores[key] = openStore{s, owner}
+	return s, nil
+}
@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	dir := t.TempDir()
+	for kind, path := range map[string]string{
+		"memory": "",
+		"file":   filepath.Join(dir, "registrations.json"),
+		"sqlite": filepath.Join(dir, "registrations.db"),
+	} {
+		store, err := Open("test", kind, path)
+		if err != nil {
+			t.Fatalf("%s: cannot open store: %s", kind, err)
+		}
+		reg, secret, err := New("https://example.org/up", time.Hour)
+		if err != nil {
+			t.Fatalf("%s: cannot create registration: %s", kind, err)
+		}
+		reg.Keys = "receiver keys"
+		expired, _, _ := New("https://example.org/expired", -time.Hour)
+		if err := store.Put(reg); err != nil {
+			t.Fatalf("%s: cannot put: %s", kind, err)
+		}
+		store.Put(expired)
+
+		got, err := store.Get(reg.ID)
+		if err != nil || got == nil || got.Endpoint != reg.Endpoint || got.Keys != reg.Keys || !got.CheckSecret(secret) {
+			t.Fatalf("%s: unexpected registration %v, %s", kind, got, err)
+		}
+		if got, _ := store.Get(expired.ID); got != nil {
+			t.Fatalf("%s: expired registration returned", kind)
+		}
+		if n, err := store.Purge(time.Now()); n != 1 || err != nil {
+			t.Fatalf("%s: purged %d registrations, %s", kind, n, err)
+		}
+		if kind == "file" {
+			// Reload from disk
+			reloaded, err := newFileStore(path)
+			if err != nil {
+				t.Fatalf("file: cannot reload: %s", err)
+			}
+			if got, _ := reloaded.Get(reg.ID); got == nil {
+				t.Fatal("file: registration not saved")
+			}
+			reloaded.journal.Close()
+		}
+		if err := store.Delete(reg.ID); err != nil {
+			t.Fatalf("%s: cannot delete: %s", kind, err)
+		}
+		if got, _ := store.Get(reg.ID); got != nil {
+			t.Fatalf("%s: deleted registration returned", kind)
+		}
+	}
+}
+
+func TestStoresPerGateway(t *testing.T) {
+	a, _ := Open("a", "memory", "")
+	b, _ := Open("b", "memory", "")
+	reg, _, _ := New("https://example.org/up", time.Hour)
+	a.Put(reg)
+	if got, _ := b.Get(reg.ID); got != nil {
+		t.Fatal("memory stores are shared between gateways")
+	}
+	if again, _ := Open("a", "memory", ""); again != a {
+		t.Fatal("memory store of a gateway not reused")
+	}
+
+	path := filepath.Join(t.TempDir(), "registrations.json")
+	if _, err := Open("a", "file", path); err != nil {
+		t.Fatalf("cannot open store: %s", err)
+	}
+	if _, err := Open("b", "file", path); err == nil {
+		t.Fatal("file store shared between gateways")
+	}
+}
+
+func TestFileJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrations.json")
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("cannot open store: %s", err)
+	}
+	var regs []Registration
+	for i := 0; i < 3; i++ {
+		reg, _, _ := New("https://example.org/up", time.Hour)
+		store.Put(reg)
+		regs = append(regs, reg)
+	}
+	store.Delete(regs[0].ID)
+	if lines := countLines(t, path); lines != 4 {
+		t.Fatalf("changes should be appended to the journal, got %d lines", lines)
+	}
+
+	reloaded, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("cannot reload: %s", err)
+	}
+	if n, _ := reloaded.Count(); n != 2 {
+		t.Fatalf("reloaded %d registrations", n)
+	}
+	if got, _ := reloaded.Get(regs[0].ID); got != nil {
+		t.Fatal("deleted registration reloaded")
+	}
+	if lines := countLines(t, path); lines != 2 {
+		t.Fatalf("journal should be compacted when opened, got %d lines", lines)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestFileJournalTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrations.json")
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("cannot open store: %s", err)
+	}
+	reg, _, _ := New("https://example.org/up", time.Hour)
+	store.Put(reg)
+	store.journal.Close()
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"ID":"partial","Endpoint":"https://exa`)
+	f.Close()
+	reloaded, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("an incomplete last line should be skipped: %s", err)
+	}
+	if got, _ := reloaded.Get(reg.ID); got == nil {
+		t.Fatal("complete registrations should be reloaded")
+	}
+	if lines := countLines(t, path); lines != 1 {
+		t.Fatalf("the incomplete line should be dropped, got %d lines", lines)
+	}
+	reloaded.journal.Close()
+
+	b, _ := os.ReadFile(path)
+	os.WriteFile(path, append([]byte("{\"ID\":\"corrupted\n"), b...), 0600)
+	if _, err := newFileStore(path); err == nil {
+		t.Fatal("corruption in the middle of the journal should be an error")
+	}
+}
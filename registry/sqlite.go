@@ -0,0 +1,78 @@
+//go:build (darwin && (amd64 || arm64)) || (freebsd && (386 || amd64 || arm || arm64)) || (linux && (386 || amd64 || arm || arm64 || ppc64le || riscv64 || s390x)) || (netbsd && amd64) || (openbsd && (amd64 || arm64)) || (windows && (amd64 || arm64))
+
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSqliteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, errors.New("registration store path cannot be empty")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite doesn't support concurrent writers
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS registrations (
+		id TEXT PRIMARY KEY,
+		endpoint TEXT NOT NULL,
+		secret_hash BLOB NOT NULL,
+		expires INTEGER NOT NULL,
+		keys TEXT NOT NULL DEFAULT ''
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db}, nil
+}
+
+func (s *sqliteStore) Get(id string) (*Registration, error) {
+	r := Registration{ID: id}
+	var expires int64
+	err := s.db.QueryRow(`SELECT endpoint, secret_hash, expires, keys FROM registrations WHERE id = ? AND expires > ?`, id, time.Now().Unix()).
+		Scan(&r.Endpoint, &r.SecretHash, &expires, &r.Keys)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r.Expires = time.Unix(expires, 0)
+	return &r, nil
+}
+
+func (s *sqliteStore) Put(r Registration) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO registrations (id, endpoint, secret_hash, expires, keys) VALUES (?, ?, ?, ?, ?)`,
+		r.ID, r.Endpoint, r.SecretHash, r.Expires.Unix(), r.Keys)
+	return err
+}
+
+func (s *sqliteStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM registrations WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqliteStore) Count() (n int, err error) {
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM registrations`).Scan(&n)
+	return
+}
+
+func (s *sqliteStore) Purge(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM registrations WHERE expires <= ?`, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,10 @@
+//go:build !((darwin && (amd64 || arm64)) || (freebsd && (386 || amd64 || arm || arm64)) || (linux && (386 || amd64 || arm || arm64 || ppc64le || riscv64 || s390x)) || (netbsd && amd64) || (openbsd && (amd64 || arm64)) || (windows && (amd64 || arm64)))
+
+package registry
+
+import "errors"
+
+// The SQLite driver isn't available on this platform
+func newSqliteStore(path string) (Store, error) {
+	return nil, errors.New("the sqlite registration store isn't supported on this platform")
+}
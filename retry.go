@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	. "codeberg.org/UnifiedPush/common-proxies/config"
+)
+
+// Retries allowed without previous requests, so that handlers with little
+// traffic can retry too
+const retryReserve = 10
+
+// Sends the requests of a handler to push servers again when they failed
+// before being processed, within a budget of retries per request
+type retrier struct {
+	lock   sync.Mutex
+	tokens float64
+}
+
+func newRetrier() *retrier {
+	return &retrier{tokens: retryReserve}
+}
+
+// Adds the share of a retry of a request to the budget
+func (r *retrier) deposit() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.tokens = min(r.tokens+Config.Retry.Budget, retryReserve)
+}
+
+// Takes a retry from the budget, returns false if it is empty
+func (r *retrier) withdraw() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// Returns true if the request failed before being processed by the push
+// server, so sending it again doesn't duplicate the message
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+	}
+	// FCM UNAVAILABLE and INTERNAL errors are 503 and 500
+	return resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// Returns the delay before the retry following attempt, from 1: an
+// exponential backoff with full jitter
+func backoff(attempt int) time.Duration {
+	max := Config.Retry.MaxDelayDuration()
+	delay := Config.Retry.BaseDelayDuration() << (attempt - 1)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// Parses a Retry-After header, in seconds or as an HTTP date
+func parseRetryAfter(val string) (time.Duration, bool) {
+	if val == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(val); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// The context of an attempt: cancelled with the inbound request, or when
+// its deadline is over, with the values of the outbound request
+type attemptContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c attemptContext) Value(key any) any {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.values.Value(key)
+}
+
+// Sends req with client, and sends it again while it fails with a
+// retryable error, at most Config.Retry.MaxAttempts times. Every attempt
+// is cancelled when ctx is done, and retries stop when it would be done
+// before the next attempt
+func (r *retrier) do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	r.deposit()
+	req = req.WithContext(attemptContext{ctx, req.Context()})
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt >= Config.Retry.MaxAttempts || !retryable(resp, err) {
+			return resp, err
+		}
+		delay := backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				if retryAfter > Config.Retry.MaxDelayDuration() {
+					// Let the sender retry later
+					return resp, err
+				}
+				delay = retryAfter
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+		if !r.withdraw() {
+			logV("retry: budget exhausted, not retrying request to", req.URL.Host)
+			return resp, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4000))
+			resp.Body.Close()
+		}
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if next.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = next
+		logV("retry: attempt", attempt+1, "to", req.URL.Host, "after", delay.Round(time.Millisecond))
+	}
+}
@@ -14,8 +14,12 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"codeberg.org/UnifiedPush/common-proxies/utils"
 	"golang.org/x/oauth2"
@@ -33,51 +37,185 @@ type FCM struct {
 	Enabled          bool   `env:"UP_REWRITE_FCM_ENABLE"`
 	CredentialsPath  string `env:"UP_REWRITE_FCM_CREDENTIALS_PATH"`
 	CredentialsPaths map[string]string
-	ConfigFactory    FCMConfigFactory
+	// Overrides of the FCM API and of the OAuth token endpoint of the
+	// credentials, to test with local servers
+	BaseUrl       string `env:"UP_REWRITE_FCM_BASE_URL"`
+	TokenUrl      string `env:"UP_REWRITE_FCM_TOKEN_URL"`
+	ConfigFactory FCMConfigFactory
 }
 
-var googleConfigs = map[string]FCMConfig{}
+// URLs used with the credentials
+type googleEndpoints struct {
+	baseUrl string
+	// Empty to use the token_uri of the credentials
+	tokenUrl string
+}
+
+// Config of a service account file, reloaded when the file changes
+type googleCredentials struct {
+	config    *FCMConfig
+	err       error
+	modTime   time.Time
+	size      int64
+	endpoints googleEndpoints
+}
+
+var googleConfigs = map[string]*googleCredentials{}
 var googleConfigsLock = sync.RWMutex{}
 
-func googleConfigFactory(credentialsPath string) (config *FCMConfig, error error) {
-	googleConfigsLock.Lock()
-	defer googleConfigsLock.Unlock()
+func newGoogleConfigFactory(endpoints googleEndpoints) FCMConfigFactory {
+	return func(credentialsPath string) (config *FCMConfig, error error) {
+		googleConfigsLock.RLock()
+		creds, exists := googleConfigs[credentialsPath]
+		googleConfigsLock.RUnlock()
+
+		if !exists || creds.endpoints != endpoints {
+			creds = loadGoogleCredentials(credentialsPath, endpoints)
+		}
+		if creds.err != nil {
+			return nil, fmt.Errorf("FCM credentials %s can't be used: %w", credentialsPath, creds.err)
+		}
+		return creds.config, nil
+	}
+}
 
-	existing, exists := googleConfigs[credentialsPath]
-	if exists {
-		return &existing, nil
+// Reads the service account file at credentialsPath, and caches its config,
+// or the error
+func loadGoogleCredentials(credentialsPath string, endpoints googleEndpoints) *googleCredentials {
+	creds := &googleCredentials{endpoints: endpoints}
+	info, err := os.Stat(credentialsPath)
+	if err == nil {
+		creds.modTime = info.ModTime()
+		creds.size = info.Size()
+		creds.config, err = readGoogleCredentials(credentialsPath, endpoints)
+	}
+	creds.err = err
+	if err != nil {
+		log.Println("FCM credentials", credentialsPath, "can't be used:", err)
+	} else {
+		log.Println("FCM credentials loaded from", credentialsPath)
 	}
 
+	googleConfigsLock.Lock()
+	googleConfigs[credentialsPath] = creds
+	googleConfigsLock.Unlock()
+	return creds
+}
+
+func readGoogleCredentials(credentialsPath string, endpoints googleEndpoints) (*FCMConfig, error) {
 	jsonData, err := os.ReadFile(credentialsPath)
 	if err != nil {
-		return nil, utils.NewProxyError(500, errors.New("could not load credentials file"))
+		return nil, errors.New("could not load credentials file")
+	}
+	if endpoints.tokenUrl != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(jsonData, &fields); err != nil {
+			return nil, fmt.Errorf("could not parse credentials file: %w", err)
+		}
+		fields["token_uri"] = endpoints.tokenUrl
+		jsonData, _ = json.Marshal(fields)
 	}
 
 	conf, err := google.CredentialsFromJSON(context.Background(), jsonData, "https://www.googleapis.com/auth/firebase.messaging")
 	if err != nil {
-		log.Println(err)
-		return nil, utils.NewProxyError(500, errors.New("could not create FCM credential source"))
+		return nil, fmt.Errorf("could not create FCM credential source: %w", err)
 	}
 
-	source := FCMConfig{
+	return &FCMConfig{
 		TokenSource: oauth2.ReuseTokenSource(nil, conf.TokenSource),
-		ApiUrl:      fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", conf.ProjectID),
+		ApiUrl:      fmt.Sprintf("%s/v1/projects/%s/messages:send", endpoints.baseUrl, conf.ProjectID),
+	}, nil
+}
+
+// Reloads the credentials at credentialsPath if the file has changed since
+// they were loaded
+func reloadGoogleCredentials(credentialsPath string, endpoints googleEndpoints) {
+	googleConfigsLock.RLock()
+	creds, exists := googleConfigs[credentialsPath]
+	googleConfigsLock.RUnlock()
+
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(credentialsPath); err == nil {
+		modTime = info.ModTime()
+		size = info.Size()
+	}
+	if exists && creds.modTime.Equal(modTime) && creds.size == size && creds.endpoints == endpoints {
+		return
+	}
+	loadGoogleCredentials(credentialsPath, endpoints)
+}
+
+// Forgets the credentials at credentialsPath, they are read again, with a new
+// token source, for the next request
+func invalidateGoogleCredentials(credentialsPath string) {
+	googleConfigsLock.Lock()
+	defer googleConfigsLock.Unlock()
+	if _, exists := googleConfigs[credentialsPath]; exists {
+		log.Println("FCM credentials", credentialsPath, "have been rejected by FCM, they will be reloaded")
+		delete(googleConfigs, credentialsPath)
+	}
+}
+
+// Key of the credentials path in the context of the requests to FCM
+type fcmCredentialsPath struct{}
+
+func (f FCM) endpoints() googleEndpoints {
+	return googleEndpoints{baseUrl: f.BaseUrl, tokenUrl: f.TokenUrl}
+}
+
+// Returns the credentials paths of the configuration
+func (f FCM) credentialsPaths() (paths []string) {
+	if f.CredentialsPath != "" {
+		paths = append(paths, f.CredentialsPath)
 	}
-	googleConfigs[credentialsPath] = source
-	return &source, nil
+	for _, path := range f.CredentialsPaths {
+		paths = append(paths, path)
+	}
+	return
 }
 
 func (f FCM) Load() (err error) {
-	// TODO: load config once
 	log.Println(`
 
 			!! This way to send FCM messages is deprecated !!
 			Please use wp_fcm instead.
 
 		`)
+	if f.Enabled {
+		for _, path := range f.credentialsPaths() {
+			loadGoogleCredentials(path, f.endpoints())
+		}
+	}
 	return
 }
 
+func (f FCM) Duration() time.Duration {
+	return 30 * time.Second
+}
+
+// Reloads the credentials files that have changed
+func (f *FCM) Tick() {
+	if !f.Enabled {
+		return
+	}
+	for _, path := range f.credentialsPaths() {
+		reloadGoogleCredentials(path, f.endpoints())
+	}
+}
+
+// Returns the error of the first credentials that can't be used
+func (f FCM) Health() error {
+	googleConfigsLock.RLock()
+	defer googleConfigsLock.RUnlock()
+	for _, path := range f.credentialsPaths() {
+		if creds, exists := googleConfigs[path]; exists && creds.err != nil {
+			return fmt.Errorf("FCM credentials %s can't be used: %w", path, creds.err)
+		}
+	}
+	return nil
+}
+
 func (f FCM) Path() string {
 	if f.Enabled {
 		return "/FCM"
@@ -86,8 +224,45 @@ func (f FCM) Path() string {
 }
 
 type fcmData struct {
-	Token string            `json:"token"`
-	Data  map[string]string `json:"data"`
+	Token   string            `json:"token"`
+	Data    map[string]string `json:"data"`
+	Android *fcmAndroid       `json:"android,omitempty"`
+}
+
+// AndroidConfig of the FCM HTTP v1 API
+type fcmAndroid struct {
+	CollapseKey string `json:"collapse_key,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+}
+
+// FCM keeps messages for at most 4 weeks
+const fcmMaxTTL = 28 * 24 * 60 * 60
+
+// Translates the WebPush TTL, Urgency and Topic headers to the FCM
+// android options. Returns nil if none is set
+func fcmAndroidConfig(header http.Header) (*fcmAndroid, error) {
+	h := http.Header{}
+	if err := utils.CopyWebPushHeaders(header, h); err != nil {
+		return nil, err
+	}
+	android := fcmAndroid{CollapseKey: h.Get("Topic")}
+	if val := h.Get("TTL"); val != "" {
+		ttl, _ := strconv.Atoi(val)
+		android.TTL = fmt.Sprintf("%ds", min(ttl, fcmMaxTTL))
+	}
+	switch h.Get("Urgency") {
+	case "":
+	case "high":
+		android.Priority = "HIGH"
+	default:
+		// FCM has no lower priority
+		android.Priority = "NORMAL"
+	}
+	if android == (fcmAndroid{}) {
+		return nil, nil
+	}
+	return &android, nil
 }
 
 type fcmPayload struct {
@@ -136,67 +311,148 @@ func (f FCM) Req(body []byte, req http.Request) (requests []*http.Request, error
 		return nil, utils.NewProxyError(500, err)
 	}
 
-	var data map[string]string
-	var data2 map[string]string = nil
+	android, err := fcmAndroidConfig(req.Header)
+	if err != nil {
+		return nil, utils.NewProxyError(400, err)
+	}
+
+	var parts []map[string]string
 
 	if isV2 {
-		b := base64.StdEncoding.EncodeToString(body)
-		if len(b) < 3800 {
-			data = map[string]string{"b": b, "i": instance}
-		} else {
-			m := fmt.Sprint(rand.Int63() + 1) // +1 to ensure 0 isn't included
-			data = map[string]string{"b": b[:3000], "i": instance, "m": m, "s": "1"}
-			data2 = map[string]string{"b": b[3000:], "i": instance, "m": m, "s": "2"}
+		parts, err = fcmParts(base64.StdEncoding.EncodeToString(body), instance)
+		if err != nil {
+			return nil, err
 		}
 	} else {
 		if app == "" && instance != "" {
-			data = map[string]string{"body": string(body), "instance": instance}
+			parts = []map[string]string{{"body": string(body), "instance": instance}}
 		} else if app != "" && instance == "" {
-			data = map[string]string{"body": string(body), "app": app}
+			parts = []map[string]string{{"body": string(body), "app": app}}
 		} else {
 			return nil, utils.NewProxyError(404, errors.New("Invalid query params in v1 FCM"))
 		}
 	}
 
-	myreq, err := f.makeReqFromValues(fcmData{Token: token, Data: data}, config)
-	if err != nil {
-		return nil, err
-	}
-	requests = append(requests, myreq)
-
-	if data2 != nil {
-		myreq, err := f.makeReqFromValues(fcmData{Token: token, Data: data2}, config)
+	for _, data := range parts {
+		myreq, err := f.makeReqFromValues(fcmData{Token: token, Data: data, Android: android}, config)
 		if err != nil {
 			return nil, err
 		}
-		requests = append(requests, myreq)
+		requests = append(requests, myreq.WithContext(context.WithValue(myreq.Context(), fcmCredentialsPath{}, credentialsPath)))
 	}
 
 	return requests, nil
 }
 
+// Size of the data of an FCM message, FCM rejects messages with more than
+// 4096 bytes of data, keys included. Keep a margin
+const fcmMaxData = 3800
+
+// Messages needing more parts are rejected
+const fcmMaxParts = 4
+
+// Returns the size of data counted by FCM
+func fcmDataSize(data map[string]string) (size int) {
+	for k, v := range data {
+		size += len(k) + len(v)
+	}
+	return
+}
+
+// Splits the base64 body b into the data of FCM messages. If b doesn't fit
+// in one message, each part has the message id m, its sequence s from 1,
+// and the number of parts n
+func fcmParts(b string, instance string) ([]map[string]string, error) {
+	data := map[string]string{"b": b, "i": instance}
+	if fcmDataSize(data) <= fcmMaxData {
+		return []map[string]string{data}, nil
+	}
+	m := fmt.Sprint(rand.Int63() + 1) // +1 to ensure 0 isn't included
+	maxCount := fmt.Sprint(fcmMaxParts)
+	chunk := fcmMaxData - fcmDataSize(map[string]string{"b": "", "i": instance, "m": m, "s": maxCount, "n": maxCount})
+	if chunk <= 0 {
+		return nil, utils.NewProxyErrS(413, "Instance too long for FCM")
+	}
+	count := (len(b) + chunk - 1) / chunk
+	if count > fcmMaxParts {
+		return nil, utils.NewProxyErrS(413, "Message too large for FCM: %d parts needed, at most %d", count, fcmMaxParts)
+	}
+	parts := make([]map[string]string, count)
+	for i := range parts {
+		end := min((i+1)*chunk, len(b))
+		parts[i] = map[string]string{"b": b[i*chunk : end], "i": instance, "m": m, "s": fmt.Sprint(i + 1), "n": fmt.Sprint(count)}
+	}
+	return parts, nil
+}
+
 type fcmResp struct {
 	Name string
 }
 
 type fcmErr struct {
 	Message string
+	Error   struct {
+		Message string
+		Status  string
+		Details []struct {
+			ErrorCode string
+		}
+	}
+}
+
+func (e fcmErr) errorCode() string {
+	for _, d := range e.Error.Details {
+		if d.ErrorCode != "" {
+			return d.ErrorCode
+		}
+	}
+	return ""
+}
+
+// Returns the status to give to the WebPush sender for an FCM HTTP v1 error
+// with the HTTP status code
+func fcmErrorStatus(code int, e fcmErr) int {
+	switch utils.ClassifyFCMError(e.Error.Status, e.errorCode()) {
+	case utils.Gone:
+		// The token has expired or the app has been uninstalled
+		return 410
+	case utils.Transient:
+		if code == 429 {
+			return 429
+		}
+		return 502
+	}
+	// 400 is an invalid message, 403 a token of another project, like a
+	// VAPID key mismatch. Other errors come from common-proxies or FCM,
+	// not from the sender
+	if code == 400 || code == 403 {
+		return code
+	}
+	return 502
 }
 
 func (f FCM) RespCode(resp *http.Response) *utils.ProxyError {
 	b, _ := io.ReadAll(io.LimitReader(resp.Body, 5000))
-	switch resp.StatusCode / 100 {
-	case 4: // 4xx
+	if resp.StatusCode == http.StatusUnauthorized && resp.Request != nil {
+		if path, ok := resp.Request.Context().Value(fcmCredentialsPath{}).(string); ok {
+			invalidateGoogleCredentials(path)
+		}
+	}
+	if resp.StatusCode >= 400 {
 		out := fcmErr{}
-		err := json.Unmarshal(b, &out)
-		if err != nil {
-			// Not even to extract err from body
-			return utils.NewProxyErrS(500, "Error with common-proxies auth or json, not app server, this should not be happening")
+		if err := json.Unmarshal(b, &out); err != nil {
+			log.Println("FCM error:", resp.Status, "without details")
+		} else {
+			log.Println("FCM error:", resp.Status, out.Error.Status, out.errorCode(), out.Error.Message)
+		}
+		perr := utils.NewProxyErrS(fcmErrorStatus(resp.StatusCode, out), "FCM error %s: %s %s", resp.Status, out.errorCode(), out.Error.Message)
+		if perr.Code == 429 || perr.Code == 502 {
+			perr.RetryAfter = resp.Header.Get("Retry-After")
+		}
+		if perr.Code == 429 && perr.RetryAfter == "" {
+			perr.RetryAfter = "60"
 		}
-		return utils.NewProxyErrS(resp.StatusCode, "FCM error: %s", out.Message)
-	case 5: // 5xx
-		//TODO implement forced exponential backoff in common-proxies
-		return utils.NewProxyErrS(429, "slow down")
+		return perr
 	}
 
 	out := fcmResp{}
@@ -210,6 +466,11 @@ func (f FCM) RespCode(resp *http.Response) *utils.ProxyError {
 	//TODO log
 }
 
+func isHttpUrl(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
 func (f *FCM) Defaults() (failed bool) {
 	if !f.Enabled {
 		return
@@ -218,6 +479,17 @@ func (f *FCM) Defaults() (failed bool) {
 		log.Println("FCM credentials path cannot be empty")
 		failed = true
 	}
-	f.ConfigFactory = googleConfigFactory
+	if f.BaseUrl == "" {
+		f.BaseUrl = "https://fcm.googleapis.com"
+	} else if !isHttpUrl(f.BaseUrl) {
+		log.Println("FCM base URL must be an http or https URL")
+		failed = true
+	}
+	f.BaseUrl = strings.TrimSuffix(f.BaseUrl, "/")
+	if f.TokenUrl != "" && !isHttpUrl(f.TokenUrl) {
+		log.Println("FCM token URL must be an http or https URL")
+		failed = true
+	}
+	f.ConfigFactory = newGoogleConfigFactory(f.endpoints())
 	return
 }
@@ -0,0 +1,107 @@
+package rewrite
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"log"
+	"sync"
+	"time"
+
+	"codeberg.org/UnifiedPush/common-proxies/vapid"
+)
+
+// The RFC 8292 claims of the VAPID JWTs of a handler
+type VapidClaims struct {
+	// mailto: or https: contact of the operator, for the push services
+	Subject string `env:"SUBJECT"`
+	// Validity of the JWTs, in seconds, at most 24h
+	Lifetime int `env:"LIFETIME"`
+	// Fixed audience. If empty, it is the origin of each push endpoint
+	Audience string `env:"AUDIENCE"`
+}
+
+func (c *VapidClaims) Defaults(handler string) (failed bool) {
+	if c.Subject == "" {
+		log.Println(handler, "VAPID subject is not set, push services will see", vapid.DefaultSubject, "as the contact")
+		c.Subject = vapid.DefaultSubject
+	} else if err := vapid.ValidateSubject(c.Subject); err != nil {
+		log.Println(handler, "VAPID subject:", err)
+		failed = true
+	}
+	if c.Lifetime == 0 {
+		c.Lifetime = 2 * 60 * 60 // 2h
+	} else if c.Lifetime < 0 || c.lifetime() > vapid.MaxLifetime {
+		log.Println(handler, "VAPID lifetime must be between 1 and", int(vapid.MaxLifetime.Seconds()), "seconds")
+		failed = true
+	}
+	if c.Audience != "" {
+		if err := vapid.ValidateAudience(c.Audience); err != nil {
+			log.Println(handler, "VAPID audience:", err)
+			failed = true
+		}
+	}
+	return
+}
+
+func (c VapidClaims) lifetime() time.Duration {
+	return time.Duration(c.Lifetime) * time.Second
+}
+
+// Returns the audience of the JWTs for endpoint
+func (c VapidClaims) audience(endpoint string) (string, error) {
+	if c.Audience != "" {
+		return c.Audience, nil
+	}
+	return vapid.Audience(endpoint)
+}
+
+type vapidToken struct {
+	auth string
+	exp  time.Time
+}
+
+// Mints the VAPID authorizations of a key, and caches them by audience
+// until half of their lifetime
+type vapidSigner struct {
+	key    ecdsa.PrivateKey
+	claims VapidClaims
+	lock   sync.Mutex
+	tokens map[string]vapidToken
+}
+
+func newVapidSigner(key ecdsa.PrivateKey, claims VapidClaims) *vapidSigner {
+	return &vapidSigner{key: key, claims: claims, tokens: map[string]vapidToken{}}
+}
+
+// Returns the Authorization header for a request to endpoint
+func (s *vapidSigner) auth(endpoint string) (string, error) {
+	aud, err := s.claims.audience(endpoint)
+	if err != nil {
+		return "", err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if t, ok := s.tokens[aud]; ok && t.exp.Sub(now) > s.claims.lifetime()/2 {
+		return t.auth, nil
+	}
+	exp := now.Add(s.claims.lifetime())
+	auth, err := vapid.GenAuthClaims(rand.Reader, s.key, vapid.Claims{Aud: aud, Exp: exp.Unix(), Sub: s.claims.Subject})
+	if err != nil {
+		return "", err
+	}
+	s.tokens[aud] = vapidToken{auth, exp}
+	return auth, nil
+}
+
+// Removes the expired tokens
+func (s *vapidSigner) purge() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for aud, t := range s.tokens {
+		if now.After(t.exp) {
+			delete(s.tokens, aud)
+		}
+	}
+}
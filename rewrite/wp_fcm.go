@@ -2,8 +2,7 @@ package rewrite
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,11 +10,15 @@ import (
 	"regexp"
 	"time"
 
+	"codeberg.org/UnifiedPush/common-proxies/ece"
 	"codeberg.org/UnifiedPush/common-proxies/utils"
 	"codeberg.org/UnifiedPush/common-proxies/vapid"
 	"golang.org/x/oauth2"
 )
 
+// The push server WebPush FCM requests are sent to
+const WebPushFCMOrigin = "https://fcm.googleapis.com"
+
 type WebPushFCMConfigFactory func(credentialsPath string) (config *FCMConfig, error error)
 
 type WebPushFCMConfig struct {
@@ -26,38 +29,53 @@ type WebPushFCMConfig struct {
 type WebPushFCM struct {
 	Enabled         bool   `env:"UP_REWRITE_WEBPUSH_FCM_ENABLE"`
 	CredentialsPath string `env:"UP_REWRITE_WEBPUSH_FCM_CREDENTIALS_PATH"`
-	privateKey      ecdsa.PrivateKey
-	auth            string ""
+	// VAPID keys for specific hostnames, so subscriptions of different apps
+	// are bound to different keys
+	CredentialsPaths map[string]string `env:"UP_REWRITE_WEBPUSH_FCM_CREDENTIALS_PATHS"`
+	// Reject requests that are not aes128gcm or aesgcm WebPush messages
+	StrictEncryption bool        `env:"UP_REWRITE_WEBPUSH_FCM_STRICT_ENCRYPTION"`
+	VAPID            VapidClaims `envPrefix:"UP_REWRITE_WEBPUSH_FCM_VAPID_"`
+	signer           *vapidSigner
+	signers          map[string]*vapidSigner
 }
 
 func (f *WebPushFCM) Load() (err error) {
 	if !f.Enabled {
 		return
 	}
-	b, err := os.ReadFile(f.CredentialsPath)
+	if f.CredentialsPath != "" {
+		if f.signer, err = f.loadSigner(f.CredentialsPath, "WebPushFCM PublicKey: "); err != nil {
+			return
+		}
+	}
+	f.signers = map[string]*vapidSigner{}
+	for host, path := range f.CredentialsPaths {
+		if f.signers[host], err = f.loadSigner(path, "WebPushFCM PublicKey for "+host+": "); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Returns the signer of the VAPID key at path, and logs its public key
+func (f WebPushFCM) loadSigner(path string, prefix string) (*vapidSigner, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		log.Println("Cannot read " + f.CredentialsPath)
-		return
+		log.Println("Cannot read " + path)
+		return nil, err
 	}
 	private, err := vapid.DecodePriv(b)
 	if err != nil {
-		log.Println("Cannot decode privkey")
-		return
+		log.Println("Cannot decode privkey", path, err)
+		return nil, err
 	}
-	f.privateKey = *private
 	pubkey, err := vapid.EncodePub(private.PublicKey)
 	if err != nil {
 		log.Println("Cannot encode pubkey")
-		return
-	}
-	log.Println("WebPushFCM PublicKey: " + pubkey)
-	auth, err := vapid.GenAuth(rand.Reader, f.privateKey, "https://fcm.googleapis.com", int(time.Now().Add(2*time.Hour).Unix()))
-	if err != nil {
-		log.Println("Cannot gen new auth !! ", err)
-		return
+		return nil, err
 	}
-	f.auth = auth
-	return
+	log.Println(prefix + pubkey)
+	return newVapidSigner(*private, f.VAPID), nil
 }
 
 func (f WebPushFCM) Path() string {
@@ -71,14 +89,14 @@ func (f WebPushFCM) Duration() time.Duration {
 	return 30 * time.Minute
 }
 
+// Removes the expired VAPID authorizations, they are renewed when needed
 func (f *WebPushFCM) Tick() {
-	auth, err := vapid.GenAuth(rand.Reader, f.privateKey, "https://fcm.googleapis.com", int(time.Now().Add(2*time.Hour).Unix()))
-	if err != nil {
-		log.Println("Cannot gen new auth !! ", err)
-		return
+	if f.signer != nil {
+		f.signer.purge()
+	}
+	for _, signer := range f.signers {
+		signer.purge()
 	}
-	fmt.Println("New auth " + auth)
-	f.auth = auth
 }
 
 // Adds TTL and Content-Encoding headers if not present, and VAPID authorization
@@ -88,9 +106,17 @@ func (f WebPushFCM) Req(body []byte, req http.Request) (requests []*http.Request
 	if !res {
 		return nil, utils.NewProxyError(500, fmt.Errorf("Token not valid"))
 	}
-	url := fmt.Sprintf("https://fcm.googleapis.com/fcm/send/%s", token)
+	if f.StrictEncryption {
+		if err := ece.Validate(req.Header, body); err != nil {
+			return nil, utils.NewProxyError(400, err)
+		}
+	}
+	url := fmt.Sprintf("%s/fcm/send/%s", WebPushFCMOrigin, token)
 	//url := fmt.Sprintf("http://127.0.0.1:8000/fcm/send/%s", token)
 	newReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 	if val := req.Header.Get("TTL"); val != "" {
 		newReq.Header.Set("TTL", val)
 	} else {
@@ -106,25 +132,42 @@ func (f WebPushFCM) Req(body []byte, req http.Request) (requests []*http.Request
 	} else {
 		newReq.Header.Set("Content-Encoding", "aes128gcm")
 	}
-	newReq.Header.Set("Authorization", f.auth)
+	// The key of the host, or the default one
+	signer := f.signer
+	path := f.CredentialsPath
+	if hostPath, ok := f.CredentialsPaths[req.Host]; ok {
+		signer = f.signers[req.Host]
+		path = hostPath
+	}
+	if path == "" {
+		return nil, utils.NewProxyError(404, errors.New("Endpoint doesn't exist. Wrong Host "+req.Host))
+	}
+	if signer == nil {
+		return nil, utils.NewProxyErrS(500, "WebPushFCM VAPID key is not loaded")
+	}
+	auth, err := signer.auth(url)
 	if err != nil {
-		return nil, err
+		return nil, utils.NewProxyError(500, err)
 	}
+	newReq.Header.Set("Authorization", auth)
 	requests = []*http.Request{newReq}
 	return
 }
 
 func (f WebPushFCM) RespCode(resp *http.Response) *utils.ProxyError {
-	return utils.NewProxyErrS(resp.StatusCode, "")
+	return utils.NewProxyErrS(utils.WebPushStatus(resp.StatusCode), "")
 }
 
 func (f *WebPushFCM) Defaults() (failed bool) {
 	if !f.Enabled {
 		return
 	}
-	if len(f.CredentialsPath) == 0 {
+	if len(f.CredentialsPath) == 0 && len(f.CredentialsPaths) == 0 {
 		log.Println("WebPushFCM Credentials path cannot be empty")
 		failed = true
 	}
+	if f.VAPID.Defaults("WebPushFCM") {
+		failed = true
+	}
 	return
 }
@@ -16,6 +16,13 @@ type Gateway interface {
 	Req([]byte, http.Request) ([]*http.Request, error)
 }
 
+// A Gateway with extra routes under its path,
+// like token issuance
+type RoutedGateway interface {
+	Gateway
+	Routes() map[string]http.HandlerFunc
+}
+
 type Proxy interface {
 	Handler
 	RespCode(*http.Response) *utils.ProxyError
@@ -28,6 +35,12 @@ type TickerHandler interface {
 	Tick()
 }
 
+// A Handler depending on a state that can break, like credentials
+type HealthChecker interface {
+	Handler
+	Health() error
+}
+
 type Handler interface {
 	Load() (err error)
 	Path() string
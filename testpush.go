@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "codeberg.org/UnifiedPush/common-proxies/config"
+	"codeberg.org/UnifiedPush/common-proxies/ece"
+	"codeberg.org/UnifiedPush/common-proxies/rewrite"
+	"codeberg.org/UnifiedPush/common-proxies/vapid"
+)
+
+// A test message, sent directly to the endpoint or through a local handler
+type testPush struct {
+	endpoint string
+	receiver *ecdh.PublicKey
+	auth     []byte
+	message  string
+	vapidKey *ecdsa.PrivateKey
+	subject  string
+	// direct, generic, aesgcm or webpushfcm
+	via     string
+	ttl     int
+	urgency string
+}
+
+// A request made to a push server
+type hop struct {
+	url      string
+	status   string
+	duration time.Duration
+	err      error
+}
+
+func (h hop) String() string {
+	if h.err != nil {
+		return fmt.Sprintf("%s: %s after %s", h.url, h.err, h.duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s: %s in %s", h.url, h.status, h.duration.Round(time.Millisecond))
+}
+
+// Records the requests made by the handlers
+type hopRecorder struct {
+	next http.RoundTripper
+	lock sync.Mutex
+	hops []hop
+}
+
+func (r *hopRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := r.next.RoundTrip(req)
+	h := hop{url: req.URL.Redacted(), duration: time.Since(start), err: err}
+	if resp != nil {
+		h.status = resp.Status
+	}
+	r.lock.Lock()
+	r.hops = append(r.hops, h)
+	r.lock.Unlock()
+	return resp, err
+}
+
+// Records the requests of client, until the returned function is called
+func recordHops(client *http.Client) (*hopRecorder, func()) {
+	previous := client.Transport
+	next := previous
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	r := &hopRecorder{next: next}
+	client.Transport = r
+	return r, func() { client.Transport = previous }
+}
+
+func testPushCommand(args []string) error {
+	flags := flag.NewFlagSet("test-push", flag.ExitOnError)
+	configFile := flags.String("c", "config.toml", "path to toml file for config, used to send through a local handler")
+	endpoint := flags.String("e", "", "push endpoint. With -via webpushfcm, the FCM WebPush endpoint or token")
+	p256dh := flags.String("p256dh", "", "public key of the receiver, base64url encoded. If empty, the message is encrypted to a random key and can't be decrypted")
+	auth := flags.String("auth", "", "auth secret of the receiver, base64url encoded")
+	message := flags.String("m", "Test message from common-proxies", "message to send")
+	vapidPath := flags.String("vapid", "", "path to the VAPID private key. If empty, a new key is used")
+	subject := flags.String("sub", vapid.DefaultSubject, "VAPID contact: mailto: or https: URI")
+	via := flags.String("via", "direct", "send directly to the endpoint, or through a local handler: generic, aesgcm or webpushfcm")
+	ttl := flags.Int("ttl", 60, "TTL of the message, in seconds")
+	urgency := flags.String("urgency", "normal", "urgency of the message: very-low, low, normal or high")
+	flags.Parse(args)
+
+	if *endpoint == "" {
+		flags.Usage()
+		return errors.New("-e is required")
+	}
+	t := testPush{endpoint: *endpoint, message: *message, subject: *subject, via: *via, ttl: *ttl, urgency: *urgency}
+	if err := vapid.ValidateSubject(t.subject); err != nil {
+		return err
+	}
+
+	if *p256dh == "" {
+		private, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		t.receiver = private.PublicKey()
+		t.auth = make([]byte, ece.AuthLen)
+		if _, err := rand.Read(t.auth); err != nil {
+			return err
+		}
+		fmt.Println("No receiver key, the message is encrypted to a random key")
+	} else {
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*p256dh, "="))
+		if err == nil {
+			t.receiver, err = ecdh.P256().NewPublicKey(raw)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid p256dh: %w", err)
+		}
+		t.auth, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(*auth, "="))
+		if err != nil || len(t.auth) != ece.AuthLen {
+			return fmt.Errorf("-auth must be the %d bytes auth secret, base64url encoded", ece.AuthLen)
+		}
+	}
+
+	var err error
+	if *vapidPath == "" {
+		t.vapidKey, err = vapid.GenerateKey(rand.Reader)
+	} else {
+		t.vapidKey, err = loadVapidKey(*vapidPath)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot load VAPID key: %w", err)
+	}
+
+	if t.via != "direct" {
+		if err := ParseConf(*configFile); err != nil {
+			return err
+		}
+	}
+	return t.send(os.Stdout)
+}
+
+// Returns the request to send, and the handler to send it through,
+// nil to send it directly
+func (t testPush) request() (*http.Request, Handler, error) {
+	var body []byte
+	var err error
+	header := http.Header{}
+	target := t.endpoint
+	var handler Handler
+	// returns the gateway URL of the endpoint, signed or as a token if needed
+	var gatewayURL func(base string, endpoint string) (string, error)
+	switch t.via {
+	case "direct":
+	case "generic":
+		handler = &Config.Gateway.Generic
+		gatewayURL = Config.Gateway.Generic.GatewayURL
+	case "aesgcm":
+		handler = &Config.Gateway.Aesgcm
+		gatewayURL = Config.Gateway.Aesgcm.GatewayURL
+	case "webpushfcm":
+		handler = &Config.Rewrite.WebPushFCM
+		token := t.endpoint
+		if u, err := url.Parse(t.endpoint); err == nil && u.Host != "" {
+			token = path.Base(u.Path)
+		}
+		target = "/wpfcm?t=" + url.QueryEscape(token)
+	default:
+		return nil, nil, fmt.Errorf("Unknown handler %s", t.via)
+	}
+	if handler != nil && handler.Path() == "" {
+		return nil, nil, fmt.Errorf("The %s handler is not enabled in the config", t.via)
+	}
+	if gatewayURL != nil {
+		if target, err = gatewayURL("", t.endpoint); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.via == "aesgcm" {
+		var h *ece.AesgcmHeaders
+		h, body, err = ece.EncryptAesgcm([]byte(t.message), t.receiver, t.auth, ece.Options{})
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Encoding", "aesgcm")
+		header.Set("Encryption", h.Encryption())
+		header.Set("Crypto-Key", h.CryptoKey())
+	} else {
+		body, err = ece.EncryptWebPush([]byte(t.message), t.receiver, t.auth, ece.Options{})
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Encoding", "aes128gcm")
+	}
+
+	// The JWT is for the push server the message is finally sent to
+	upstream := t.endpoint
+	if t.via == "webpushfcm" {
+		upstream = rewrite.WebPushFCMOrigin
+	}
+	aud, err := vapid.Audience(upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims := vapid.Claims{Aud: aud, Exp: time.Now().Add(12 * time.Hour).Unix(), Sub: t.subject}
+	authorization, err := vapid.GenAuthClaims(rand.Reader, *t.vapidKey, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Set("Authorization", authorization)
+	header.Set("TTL", strconv.Itoa(t.ttl))
+	header.Set("Urgency", t.urgency)
+
+	var req *http.Request
+	if handler == nil {
+		req, err = http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		req = httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	}
+	req.Header = header
+	return req, handler, nil
+}
+
+// Sends the message, and writes the status of each hop to out
+func (t testPush) send(out io.Writer) error {
+	req, handler, err := t.request()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Sending %d bytes, %s, with the VAPID key %s\n", req.ContentLength, req.Header.Get("Content-Encoding"), vapidPubKey(t.vapidKey))
+
+	var resp *http.Response
+	if handler == nil {
+		client := &http.Client{
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+				return errors.New("NO redir")
+			},
+			Timeout: 10 * time.Second,
+		}
+		recorder, stop := recordHops(client)
+		defer stop()
+		resp, err = client.Do(req)
+		printHops(out, 1, recorder.hops)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := handler.Load(); err != nil {
+			return err
+		}
+		paranoid, stopParanoid := recordHops(paranoidClient)
+		normal, stopNormal := recordHops(normalClient)
+		defer stopParanoid()
+		defer stopNormal()
+		w := httptest.NewRecorder()
+		handle(handler)(w, req)
+		resp = w.Result()
+		fmt.Fprintf(out, "1. %s handler, %s: %s\n", t.via, req.URL, resp.Status)
+		printHops(out, 2, append(paranoid.hops, normal.hops...))
+	}
+	printResponse(out, resp)
+	if resp.StatusCode >= 300 {
+		return errors.New("The message was not accepted")
+	}
+	return nil
+}
+
+func printHops(out io.Writer, first int, hops []hop) {
+	if len(hops) == 0 {
+		fmt.Fprintf(out, "%d. No request to a push server\n", first)
+	}
+	for i, h := range hops {
+		fmt.Fprintf(out, "%d. %s\n", first+i, h)
+	}
+}
+
+// Prints the headers and body of the last response, useful to debug errors
+func printResponse(out io.Writer, resp *http.Response) {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1000))
+	resp.Body.Close()
+	for _, name := range []string{"Location", "Retry-After"} {
+		if val := resp.Header.Get(name); val != "" {
+			fmt.Fprintf(out, "   %s: %s\n", name, val)
+		}
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(out, "   %s\n", bytes.TrimSpace(body))
+	}
+}
+
+func vapidPubKey(private *ecdsa.PrivateKey) string {
+	pub, err := vapid.EncodePub(private.PublicKey)
+	if err != nil {
+		return "(invalid)"
+	}
+	return pub
+}
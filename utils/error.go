@@ -6,16 +6,18 @@ import (
 )
 
 func NewProxyError(code int, err error) *ProxyError {
-	return &ProxyError{err, code}
+	return &ProxyError{S: err, Code: code}
 }
 
 func NewProxyErrS(code int, str string, args ...interface{}) *ProxyError {
-	return &ProxyError{errors.New(fmt.Sprintf(str, args...)), code}
+	return &ProxyError{S: errors.New(fmt.Sprintf(str, args...)), Code: code}
 }
 
 type ProxyError struct {
 	S    error
 	Code int
+	// Retry-After header to give to the sender, if any
+	RetryAfter string
 }
 
 func (p ProxyError) Error() string {
@@ -0,0 +1,49 @@
+package utils
+
+// Outcome of a push request, as seen by the application server
+type Outcome int
+
+const (
+	Delivered Outcome = iota
+	// The subscription doesn't exist anymore, the sender must stop using it
+	Gone
+	// Something failed on the way, the request can be retried later
+	Transient
+	// The request has been rejected for another reason
+	Failed
+)
+
+// Classifies the status code of a push server response
+func ClassifyStatus(code int) Outcome {
+	switch {
+	case code >= 200 && code < 300:
+		return Delivered
+	case code == 404 || code == 410:
+		return Gone
+	case code == 408 || code == 429 || code >= 500:
+		return Transient
+	}
+	return Failed
+}
+
+// Classifies an FCM HTTP v1 error, from its status or from
+// the errorCode of its details
+func ClassifyFCMError(status string, errorCode string) Outcome {
+	switch {
+	case errorCode == "UNREGISTERED" || status == "NOT_FOUND":
+		return Gone
+	case errorCode == "UNAVAILABLE" || errorCode == "INTERNAL" || errorCode == "QUOTA_EXCEEDED" ||
+		status == "UNAVAILABLE" || status == "INTERNAL" || status == "RESOURCE_EXHAUSTED":
+		return Transient
+	}
+	return Failed
+}
+
+// Returns the status code to give to a WebPush sender for code:
+// every unsubscription is reported as 410 Gone
+func WebPushStatus(code int) int {
+	if ClassifyStatus(code) == Gone {
+		return 410
+	}
+	return code
+}
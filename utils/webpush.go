@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+var urgencies = []string{"very-low", "low", "normal", "high"}
+
+// RFC 8030 5.4: up to 32 characters from the URL and filename safe base64 alphabet
+var topicRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Copies the RFC 8030 TTL, Urgency and Topic headers of from to to,
+// after validating them
+func CopyWebPushHeaders(from http.Header, to http.Header) error {
+	if val := from.Get("TTL"); val != "" {
+		ttl, err := strconv.Atoi(val)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("Invalid TTL: %s", val)
+		}
+		to.Set("TTL", strconv.Itoa(ttl))
+	}
+	if val := from.Get("Urgency"); val != "" {
+		if !InStringSlice(urgencies, val) {
+			return fmt.Errorf("Invalid Urgency: %s", val)
+		}
+		to.Set("Urgency", val)
+	}
+	if val := from.Get("Topic"); val != "" {
+		if !topicRegexp.MatchString(val) {
+			return fmt.Errorf("Invalid Topic: %s", val)
+		}
+		to.Set("Topic", val)
+	}
+	return nil
+}
+
+// Sets the TTL and Urgency headers if missing, and clamps TTL to maxTTL
+func DefaultWebPushHeaders(h http.Header, maxTTL int) {
+	ttl, err := strconv.Atoi(h.Get("TTL"))
+	if err != nil || ttl < 0 || ttl > maxTTL {
+		ttl = maxTTL
+	}
+	h.Set("TTL", strconv.Itoa(ttl))
+	if h.Get("Urgency") == "" {
+		h.Set("Urgency", "normal")
+	}
+}
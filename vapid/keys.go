@@ -0,0 +1,154 @@
+package vapid
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Encodings of private keys
+type Format string
+
+const (
+	// SEC1 "EC PRIVATE KEY" PEM, the default
+	SEC1 Format = "sec1"
+	// PKCS#8 "PRIVATE KEY" PEM
+	PKCS8 Format = "pkcs8"
+	// The 32 bytes scalar, base64url encoded, as used by the web-push libraries
+	Raw Format = "raw"
+	// RFC 7517 JSON Web Key
+	JWKFormat Format = "jwk"
+)
+
+var Formats = []Format{SEC1, PKCS8, Raw, JWKFormat}
+
+func EncodePriv(private ecdsa.PrivateKey) (encoded string, err error) {
+	return EncodePrivFormat(private, SEC1)
+}
+
+// Encodes private in format
+func EncodePrivFormat(private ecdsa.PrivateKey, format Format) (encoded string, err error) {
+	switch format {
+	case SEC1:
+		marshalled, err := x509.MarshalECPrivateKey(&private)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: marshalled})), nil
+	case PKCS8:
+		marshalled, err := x509.MarshalPKCS8PrivateKey(&private)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: marshalled})), nil
+	case Raw:
+		return base64.RawURLEncoding.EncodeToString(private.D.FillBytes(make([]byte, 32))) + "\n", nil
+	case JWKFormat:
+		jwk := EncodeJWK(private.PublicKey)
+		jwk.D = base64.RawURLEncoding.EncodeToString(private.D.FillBytes(make([]byte, 32)))
+		b, err := json.Marshal(jwk)
+		return string(b) + "\n", err
+	}
+	return "", fmt.Errorf("Unknown key format %q", format)
+}
+
+// Decodes a P-256 private key, in any of the Formats
+func DecodePriv(encoded []byte) (private *ecdsa.PrivateKey, err error) {
+	encoded = bytes.TrimSpace(encoded)
+	switch {
+	case len(encoded) == 0:
+		return nil, errors.New("Private key is empty")
+	case bytes.HasPrefix(encoded, []byte("-----BEGIN")):
+		return decodePEM(encoded)
+	case encoded[0] == '{':
+		return decodeJWK(encoded)
+	}
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(string(encoded), "="))
+	if err != nil {
+		return nil, errors.New("Private key is not a PEM, a JWK or a base64url encoded scalar")
+	}
+	return fromScalar(d)
+}
+
+func decodePEM(encoded []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, errors.New("Invalid PEM private key")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		private, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SEC1 private key: %w", err)
+		}
+		return checkCurve(private)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PKCS#8 private key: %w", err)
+		}
+		private, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("PKCS#8 private key is a %T, not an EC key", key)
+		}
+		return checkCurve(private)
+	}
+	return nil, fmt.Errorf("Unsupported PEM block %q, expected EC PRIVATE KEY or PRIVATE KEY", block.Type)
+}
+
+func decodeJWK(encoded []byte) (*ecdsa.PrivateKey, error) {
+	var jwk JWK
+	if err := json.Unmarshal(encoded, &jwk); err != nil {
+		return nil, fmt.Errorf("Invalid JWK: %w", err)
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return nil, fmt.Errorf("JWK must be an EC P-256 key, got %s %s", jwk.Kty, jwk.Crv)
+	}
+	if jwk.D == "" {
+		return nil, errors.New("JWK has no private key")
+	}
+	d, err := base64.RawURLEncoding.DecodeString(jwk.D)
+	if err != nil {
+		return nil, errors.New("JWK d is not base64url encoded")
+	}
+	private, err := fromScalar(d)
+	if err != nil {
+		return nil, err
+	}
+	if public := EncodeJWK(private.PublicKey); jwk.X != "" && (jwk.X != public.X || jwk.Y != public.Y) {
+		return nil, errors.New("JWK public key doesn't match its private key")
+	}
+	return private, nil
+}
+
+// Returns the P-256 private key of the scalar d
+func fromScalar(d []byte) (*ecdsa.PrivateKey, error) {
+	if len(d) != 32 {
+		return nil, fmt.Errorf("Private key must be 32 bytes, got %d", len(d))
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid P-256 private key: %w", err)
+	}
+	public, err := DecodePub(base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PrivateKey{PublicKey: *public, D: new(big.Int).SetBytes(d)}, nil
+}
+
+func checkCurve(private *ecdsa.PrivateKey) (*ecdsa.PrivateKey, error) {
+	if private.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("VAPID keys must be P-256, got %s", private.Curve.Params().Name)
+	}
+	return private, nil
+}
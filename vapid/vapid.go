@@ -8,8 +8,13 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
 )
 
 func GenerateKey(rand io.Reader) (private *ecdsa.PrivateKey, err error) {
@@ -17,19 +22,6 @@ func GenerateKey(rand io.Reader) (private *ecdsa.PrivateKey, err error) {
 	return
 }
 
-func EncodePriv(private ecdsa.PrivateKey) (encoded string, err error) {
-	marshalled, err := x509.MarshalECPrivateKey(&private)
-	bEncoded := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: marshalled})
-	encoded = string(bEncoded)
-	return
-}
-
-func DecodePriv(encoded []byte) (private *ecdsa.PrivateKey, err error) {
-	block, _ := pem.Decode(encoded)
-	private, err = x509.ParseECPrivateKey(block.Bytes)
-	return
-}
-
 // Returns the public key encoded in the uncompressed form,
 // base64 url safe encoded
 func EncodePub(public ecdsa.PublicKey) (encoded string, err error) {
@@ -54,35 +46,195 @@ func Sign(rand io.Reader, private ecdsa.PrivateKey, toSign []byte) (signature st
 		return "", err
 	}
 
-	raw_signature := r.Bytes()
-	raw_signature = append(raw_signature, s.Bytes()...)
+	// ES256 signatures are r and s, 32 bytes each
+	raw_signature := make([]byte, 64)
+	r.FillBytes(raw_signature[:32])
+	s.FillBytes(raw_signature[32:])
 	signature = base64.RawURLEncoding.EncodeToString(raw_signature)
 	return
 }
 
+// Contact used when a handler doesn't configure one
+const DefaultSubject = "https://codeberg.org/UnifiedPush/common-proxies"
+
+// RFC 8292 2: the JWT expiry must be at most 24 hours after the request
+const MaxLifetime = 24 * time.Hour
+
 func GenAuth(rand io.Reader, private ecdsa.PrivateKey, aud string, exp int) (out string, err error) {
+	return GenAuthClaims(rand, private, Claims{Aud: aud, Exp: int64(exp), Sub: DefaultSubject})
+}
+
+// Returns the "vapid t=JWT,k=KEY" Authorization header of claims, signed with private
+func GenAuthClaims(rand io.Reader, private ecdsa.PrivateKey, claims Claims) (out string, err error) {
 	header := map[string]interface{}{
 		"alg": "ES256",
 		"typ": "JWT",
 	}
-	body := map[string]interface{}{
-		"aud": aud,
-		"exp": exp,
-		"sub": "https://codeberg.org/UnifiedPush/common-proxies",
-	}
 	header_str, err := json.Marshal(header)
 	if err != nil {
 		return "", err
 	}
-	body_str, err := json.Marshal(body)
+	body_str, err := json.Marshal(claims)
 	if err != nil {
 		return "", err
 	}
 	jwt := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(header_str), base64.RawURLEncoding.EncodeToString(body_str))
 
 	signature, err := Sign(rand, private, []byte(jwt))
+	if err != nil {
+		return "", err
+	}
 	jwt = fmt.Sprintf("%s.%s", jwt, signature)
 	pubkey, err := EncodePub(private.PublicKey)
 	out = fmt.Sprintf("vapid t=%s,k=%s", jwt, pubkey)
 	return
 }
+
+// RFC 8292 2.1: the subject is a mailto: or an https: URI to contact the sender
+func ValidateSubject(sub string) error {
+	u, err := url.Parse(sub)
+	if err != nil {
+		return fmt.Errorf("Invalid subject: %w", err)
+	}
+	switch {
+	case u.Scheme == "mailto" && strings.Contains(u.Opaque, "@"):
+		return nil
+	case u.Scheme == "https" && u.Host != "":
+		return nil
+	}
+	return fmt.Errorf("Subject must be a mailto: or an https: URI, got %q", sub)
+}
+
+// RFC 8292 2: the audience is the origin of the push resource
+func ValidateAudience(aud string) error {
+	u, err := url.Parse(aud)
+	if err != nil {
+		return fmt.Errorf("Invalid audience: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("Audience must be an origin, like https://push.example.org, got %q", aud)
+	}
+	return nil
+}
+
+// Returns the audience of the push resource endpoint: its origin
+func Audience(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("Endpoint has no origin: %s", endpoint)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// Decodes a public key encoded with EncodePub
+func DecodePub(encoded string) (public *ecdsa.PublicKey, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), raw)
+	if x == nil {
+		return nil, errors.New("Not an uncompressed P-256 public key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// RFC 7517 JSON Web Key of a P-256 key
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+// Returns the JWK of the public key
+func EncodeJWK(public ecdsa.PublicKey) JWK {
+	b := make([]byte, 64)
+	public.X.FillBytes(b[:32])
+	public.Y.FillBytes(b[32:])
+	return JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(b[:32]),
+		Y:   base64.RawURLEncoding.EncodeToString(b[32:]),
+	}
+}
+
+// Claims of a VAPID JWT
+type Claims struct {
+	Aud string `json:"aud"`
+	Exp int64  `json:"exp"`
+	Sub string `json:"sub,omitempty"`
+}
+
+// Verifies the ES256 signature of jwt with public, and returns its claims.
+// The claims aren't validated
+func VerifyJWT(jwt string, public ecdsa.PublicKey) (claims Claims, err error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("JWT must have 3 parts")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err = decodePart(parts[0], &header); err != nil {
+		return claims, fmt.Errorf("Invalid JWT header: %w", err)
+	}
+	if header.Alg != "ES256" {
+		return claims, fmt.Errorf("Unsupported JWT algorithm: %s", header.Alg)
+	}
+	if err = decodePart(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("Invalid JWT claims: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return claims, errors.New("JWT signature must be 64 bytes, base64url encoded")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&public, hash[:], r, s) {
+		return claims, errors.New("Invalid JWT signature")
+	}
+	return claims, nil
+}
+
+func decodePart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Parses an RFC 8292 "vapid t=JWT, k=KEY" Authorization header,
+// and verifies the JWT with KEY. Returns the claims and the key
+func ParseAuth(authorization string) (claims Claims, key string, err error) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !strings.EqualFold(scheme, "vapid") {
+		return claims, "", fmt.Errorf("Unsupported authorization scheme: %s", scheme)
+	}
+	var jwt string
+	for _, param := range strings.Split(params, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch strings.ToLower(name) {
+		case "t":
+			jwt = val
+		case "k":
+			key = val
+		}
+	}
+	if jwt == "" || key == "" {
+		return claims, key, errors.New("Authorization must have t and k parameters")
+	}
+	public, err := DecodePub(key)
+	if err != nil {
+		return claims, key, fmt.Errorf("Invalid key: %w", err)
+	}
+	claims, err = VerifyJWT(jwt, *public)
+	return claims, key, err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"codeberg.org/UnifiedPush/common-proxies/vapid"
+)
+
+const vapidUsage = `Usage: common-proxies vapid <action> [flags]
+
+Actions:
+  generate  print a new private key, SEC1 PEM encoded by default
+  pubkey    print the base64url public key of -k
+  jwk       print the JWK of -k
+  jwt       mint an Authorization header for -aud, signed with -k
+  verify    decode and verify an Authorization header`
+
+func vapidCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, vapidUsage)
+		return errors.New("an action is required")
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("vapid "+action, flag.ExitOnError)
+	keyPath := flags.String("k", "", "path to the VAPID private key")
+	switch action {
+	case "generate":
+		format := flags.String("format", string(vapid.SEC1), "format of the key: sec1, pkcs8, raw or jwk")
+		flags.Parse(args[1:])
+		private, err := vapid.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		out, err := vapid.EncodePrivFormat(*private, vapid.Format(*format))
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	case "pubkey":
+		flags.Parse(args[1:])
+		private, err := loadVapidKey(*keyPath)
+		if err != nil {
+			return err
+		}
+		fmt.Println(vapidPubKey(private))
+		return nil
+	case "jwk":
+		withPrivate := flags.Bool("private", false, "include the private key")
+		flags.Parse(args[1:])
+		private, err := loadVapidKey(*keyPath)
+		if err != nil {
+			return err
+		}
+		jwk := vapid.EncodeJWK(private.PublicKey)
+		if *withPrivate {
+			jwk.D = base64.RawURLEncoding.EncodeToString(private.D.FillBytes(make([]byte, 32)))
+		}
+		b, _ := json.MarshalIndent(jwk, "", "  ")
+		fmt.Println(string(b))
+		return nil
+	case "jwt":
+		aud := flags.String("aud", "", "audience: origin of the push server, for instance https://fcm.googleapis.com")
+		exp := flags.Duration("exp", 12*time.Hour, "validity of the JWT, at most 24h")
+		sub := flags.String("sub", vapid.DefaultSubject, "contact: mailto: or https: URI")
+		flags.Parse(args[1:])
+		if *aud == "" {
+			flags.Usage()
+			return errors.New("-aud is required")
+		}
+		if err := vapid.ValidateAudience(*aud); err != nil {
+			return err
+		}
+		if err := vapid.ValidateSubject(*sub); err != nil {
+			return err
+		}
+		if *exp <= 0 || *exp > vapid.MaxLifetime {
+			return errors.New("-exp must be between 0 and 24h")
+		}
+		private, err := loadVapidKey(*keyPath)
+		if err != nil {
+			return err
+		}
+		auth, err := vapid.GenAuthClaims(rand.Reader, *private, vapid.Claims{Aud: *aud, Exp: time.Now().Add(*exp).Unix(), Sub: *sub})
+		if err != nil {
+			return err
+		}
+		fmt.Println(auth)
+		return nil
+	case "verify":
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, `Usage: common-proxies vapid verify "vapid t=JWT, k=KEY"`)
+			return errors.New("an Authorization header is required")
+		}
+		claims, key, err := vapid.ParseAuth(flags.Arg(0))
+		if key != "" {
+			fmt.Println("Key:", key)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Audience:", claims.Aud)
+		fmt.Println("Subject:", claims.Sub)
+		expiry := time.Unix(claims.Exp, 0)
+		fmt.Println("Expires:", expiry.Format(time.RFC3339))
+		fmt.Println("Signature: valid")
+		if time.Now().After(expiry) {
+			return errors.New("The JWT has expired")
+		}
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, vapidUsage)
+	return fmt.Errorf("Unknown action %s", action)
+}
+
+func loadVapidKey(path string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("-k is required")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	private, err := vapid.DecodePriv(b)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode %s: %w", path, err)
+	}
+	return private, nil
+}